@@ -0,0 +1,294 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultBatchSymbols is the number of symbols fetched in one upstream
+	// request, sina accepts hundreds
+	DefaultBatchSymbols = 100
+	// DefaultBatchWindow is how long a worker gathers queued keys for a batch
+	// before it fetches the ones it has
+	DefaultBatchWindow = time.Millisecond * 50
+)
+
+// batchPollInterval is how often a batch being gathered looks for more keys.
+const batchPollInterval = time.Millisecond * 10
+
+// A Splitter is a Provider whose payloads can be split into the raw payload
+// of each symbol. Batches fetched from other providers are parsed and the
+// quotes of each key rendered with Format.
+type Splitter interface {
+	Split(b []byte) (map[string][]byte, error)
+}
+
+// GroupWithBatch makes the group's workers gather queued keys for window and
+// fetch up to symbols of them in one upstream request, symbols below 2 fetch
+// a key at a time.
+func GroupWithBatch(symbols int, window time.Duration) GroupOption {
+	return func(g *Group) {
+		g.batchSymbols = symbols
+		g.batchWindow = window
+	}
+}
+
+// symbolCount returns the number of symbols of key, 1 if it has none.
+func (g *Group) symbolCount(key string) int {
+	if g.provider == nil {
+		return 1
+	}
+	symbols, err := g.provider.Symbols(key)
+	if err != nil || len(symbols) == 0 {
+		return 1
+	}
+	return len(symbols)
+}
+
+// LeaseBatch leases keys to slave until the next one would take them past
+// symbols symbols or the group's batch window is over, whichever comes first,
+// at most the group's batch size. It returns no lease if the queue stays
+// empty.
+func (g *Group) LeaseBatch(slave string, symbols int) []Lease {
+	if symbols <= 0 || symbols > g.batchSymbols {
+		symbols = g.batchSymbols
+	}
+	reapSlaves()
+	leases := make([]Lease, 0)
+	count := 0
+	full := false
+	// a key with more symbols than the batch still makes a batch of its own
+	fits := func(key string) bool {
+		full = count > 0 && count+g.symbolCount(key) > symbols
+		return !full
+	}
+	for deadline := time.Now().Add(g.batchWindow); count < symbols; {
+		lease, ok := g.queue.LeaseIf(slave, fits)
+		if ok {
+			leases = append(leases, lease)
+			count += g.symbolCount(lease.Key)
+			continue
+		}
+		if full || len(leases) == 0 || !time.Now().Before(deadline) {
+			break
+		}
+		time.Sleep(batchPollInterval)
+	}
+	return leases
+}
+
+// fetchBatch fetches keys in as few upstream requests as the group's
+// providers allow: the symbols of every key are requested at once, and the
+// payload is split back into the value of each key. Keys a provider has no
+// quote for are tried with the next one. It returns the value or error of
+// each key, keys not fetched once ctx is done fail with its error.
+func (g *Group) fetchBatch(ctx context.Context, keys []string) (map[string][]byte, map[string]error) {
+	values := make(map[string][]byte, len(keys))
+	errs := make(map[string]error)
+	if g.provider == nil || len(keys) == 1 {
+		for _, key := range keys {
+			if b, err := g.fetch(ctx, key); err != nil {
+				errs[key] = err
+			} else {
+				values[key] = b
+			}
+		}
+		return values, errs
+	}
+
+	pending := keys
+	for _, p := range g.candidates() {
+		if len(pending) == 0 {
+			break
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		failed := g.fetchBatchFrom(ctx, p, pending, values, errs)
+		for _, key := range pending {
+			if _, ok := values[key]; ok && p != g.provider {
+				metrics.Inc("upstream_failover_total", "group", g.name, "from", g.provider.Name(), "to", p.Name())
+			}
+		}
+		pending = failed
+	}
+	for _, key := range pending {
+		if ctx.Err() != nil {
+			errs[key] = ctx.Err()
+			continue
+		}
+		fmt.Printf("fetch failed, group: %s, key: %s, error: %s\n", g.name, key, errs[key].Error())
+	}
+	return values, errs
+}
+
+// fetchBatchFrom fetches keys from provider p in one request, recording the
+// values and errors of keys, and returns the keys it got no value for.
+func (g *Group) fetchBatchFrom(ctx context.Context, p Provider, keys []string, values map[string][]byte, errs map[string]error) (failed []string) {
+	symbolsOf := make(map[string][]string, len(keys))
+	all := make([]string, 0, len(keys))
+	seen := make(map[string]bool)
+	for _, key := range keys {
+		symbols, err := p.Symbols(key)
+		if err != nil {
+			errs[key] = err
+			failed = append(failed, key)
+			continue
+		}
+		symbolsOf[key] = symbols
+		for _, symbol := range symbols {
+			if !seen[symbol] {
+				seen[symbol] = true
+				all = append(all, symbol)
+			}
+		}
+	}
+	if len(all) == 0 {
+		return failed
+	}
+
+	b, err := p.Fetch(ctx, all, FetchTimeout)
+	if ctx.Err() != nil {
+		for key := range symbolsOf {
+			errs[key] = ctx.Err()
+			failed = append(failed, key)
+		}
+		return failed
+	}
+	if err == nil {
+		err = validatePayload(p.Name(), b)
+	}
+	var parts map[string][]byte
+	var quotes map[string]Quote
+	splitter, ok := p.(Splitter)
+	if err == nil && ok {
+		parts, err = splitter.Split(b)
+	} else if err == nil {
+		quotes, err = quotesBySymbol(p, b)
+	}
+	health.record(p.Name(), err == nil)
+	if err != nil {
+		g.countInvalid(p, err)
+		metrics.Inc("upstream_requests_total", "provider", p.Name(), "result", "failure")
+		fmt.Printf("fetch batch failed, provider: %s, symbols: %d, error: %s\n", p.Name(), len(all), err.Error())
+		for key := range symbolsOf {
+			errs[key] = fmt.Errorf("%s: %w", p.Name(), err)
+			failed = append(failed, key)
+		}
+		return failed
+	}
+	metrics.Inc("upstream_requests_total", "provider", p.Name(), "result", "success")
+	metrics.Add("upstream_batch_symbols_total", float64(len(all)), "provider", p.Name())
+
+	for _, key := range keys {
+		symbols, ok := symbolsOf[key]
+		if !ok {
+			continue
+		}
+		var value []byte
+		if parts != nil {
+			var keyQuotes []Quote
+			value, keyQuotes, err = joinParts(p, symbols, parts)
+			// values of fallback providers are rendered like fetchWithFailover does
+			if err == nil && p != g.provider {
+				value = g.provider.Format(keyQuotes)
+			}
+		} else {
+			value, err = g.formatQuotes(p, symbols, quotes)
+		}
+		if err != nil {
+			g.countInvalid(p, err)
+			errs[key] = fmt.Errorf("%s: %w", p.Name(), err)
+			failed = append(failed, key)
+			continue
+		}
+		delete(errs, key)
+		values[key] = value
+	}
+	return failed
+}
+
+// joinParts joins the split payloads of symbols into the value of a key,
+// validated the way a payload fetched for the key alone would be, and
+// returns its quotes.
+func joinParts(p Provider, symbols []string, parts map[string][]byte) ([]byte, []Quote, error) {
+	var buf bytes.Buffer
+	for _, symbol := range symbols {
+		part, ok := parts[symbol]
+		if !ok {
+			return nil, nil, &PayloadError{Provider: p.Name(), Kind: ErrEmpty, Detail: "no quote for " + symbol}
+		}
+		buf.Write(part)
+	}
+	quotes, err := validate(p, symbols, buf.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	return buf.Bytes(), quotes, nil
+}
+
+// formatQuotes renders the quotes of symbols in the format of the group's
+// provider.
+func (g *Group) formatQuotes(p Provider, symbols []string, quotes map[string]Quote) ([]byte, error) {
+	keyQuotes := make([]Quote, 0, len(symbols))
+	for _, symbol := range symbols {
+		q, ok := quotes[symbol]
+		if !ok {
+			return nil, &PayloadError{Provider: p.Name(), Kind: ErrEmpty, Detail: "no quote for " + symbol}
+		}
+		keyQuotes = append(keyQuotes, q)
+	}
+	return g.provider.Format(keyQuotes), nil
+}
+
+// quotesBySymbol parses a payload of p into its quotes by symbol.
+func quotesBySymbol(p Provider, b []byte) (map[string]Quote, error) {
+	if err := p.Validate(b); err != nil {
+		return nil, err
+	}
+	parsed, err := p.Parse(b)
+	if err != nil {
+		return nil, &PayloadError{Provider: p.Name(), Kind: ErrMalformed, Detail: err.Error()}
+	}
+	quotes := make(map[string]Quote, len(parsed))
+	for _, q := range parsed {
+		quotes[q.Symbol] = q
+	}
+	return quotes, nil
+}
+
+// countInvalid counts an invalid payload of p, requests to its host were
+// slowed down already if it blocked us, see fetch.
+func (g *Group) countInvalid(p Provider, err error) {
+	var payloadErr *PayloadError
+	if errors.As(err, &payloadErr) {
+		metrics.Inc("upstream_invalid_total", "provider", p.Name(), "kind", payloadErr.Kind.Error())
+	}
+}
+
+// splitLines splits a payload of `<prefix><symbol>="...";` lines by symbol,
+// lines that aren't a symbol's, like tencent's v_pv_none_match, are left
+// out.
+func splitLines(provider string, b []byte, prefix string) (map[string][]byte, error) {
+	parts := make(map[string][]byte)
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		symbol, _, err := splitAssignment(string(line), prefix)
+		if err != nil {
+			return nil, &PayloadError{Provider: provider, Kind: ErrMalformed, Detail: err.Error()}
+		}
+		if _, _, err := splitSymbol(strings.ToLower(symbol)); err != nil {
+			continue
+		}
+		parts[symbol] = append(append(make([]byte, 0, len(line)+1), line...), '\n')
+	}
+	return parts, nil
+}
@@ -0,0 +1,91 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"stock_data_cache/utils"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchBatch(t *testing.T) {
+	health = newProviderHealth(HealthRecovery)
+	ConfigureUpstreams(UpstreamConfig{Retry: utils.RetryPolicy{Attempts: 1}, BreakerThreshold: 100})
+	defer ConfigureUpstreams(DefaultUpstreamConfig)
+
+	sina := NewSinaProvider()
+	other := testQuote
+	other.Symbol, other.Name = "sh600000", "浦发银行"
+	lines := map[string]string{
+		"sz000001": string(sina.Format([]Quote{testQuote})),
+		"sh600000": string(sina.Format([]Quote{other})),
+		"sz000002": "var hq_str_sz000002=\"\";\n",
+	}
+	queries := make([]string, 0)
+	sinaSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.RawQuery[len("list="):]
+		queries = append(queries, query)
+		for _, symbol := range strings.Split(query, ",") {
+			_, _ = fmt.Fprint(w, lines[symbol])
+		}
+	}))
+	defer sinaSrv.Close()
+	tencentSrv, _ := newStandIn(t, http.StatusInternalServerError, "")
+	tencent := NewTencentProvider()
+	sina.api = sinaSrv.URL + "/?list="
+	tencent.api = tencentSrv.URL + "/?q="
+	g := NewGroup("batched", 2<<10, nil, GroupWithProvider(sina), GroupWithFailover(tencent))
+
+	values, errs := g.fetchBatch(context.Background(), []string{"sz000001", "sh600000,sz000001", "sz000002"})
+	if len(queries) != 1 || queries[0] != "sz000001,sh600000,sz000002" {
+		t.Fatalf("expect the symbols fetched at once, but %v got", queries)
+	}
+	if string(values["sz000001"]) != lines["sz000001"] || string(values["sh600000,sz000001"]) != lines["sh600000"]+lines["sz000001"] {
+		t.Fatalf("expect the payload split per key, but %q got", values)
+	}
+	if _, ok := errs["sz000002"]; !ok || len(errs) != 1 {
+		t.Fatalf("expect only the unknown symbol to fail, but %v got", errs)
+	}
+}
+
+func TestLeaseBatch(t *testing.T) {
+	g := NewGroup("leased", 2<<10, GetterFunc(func(key string) ([]byte, error) { return []byte(key), nil }),
+		GroupWithBatch(3, time.Millisecond*20))
+	for _, key := range []string{"a", "b", "c", "d"} {
+		g.SendMissedCache(key)
+	}
+	if leases := g.LeaseBatch("", 0); len(leases) != 3 {
+		t.Fatalf("expect a batch of 3, but %d got", len(leases))
+	}
+	start := time.Now()
+	if leases := g.LeaseBatch("", 0); len(leases) != 1 || time.Since(start) < time.Millisecond*20 {
+		t.Fatalf("expect the window to pass gathering a batch, but %d got", len(leases))
+	}
+	if leases := g.LeaseBatch("", 0); len(leases) != 0 {
+		t.Fatal("expect no batch of an empty queue")
+	}
+
+	for _, key := range []string{"e", "f"} {
+		g.SendMissedCache(key)
+	}
+	if empty, err := g.UpdateMissedBatch(context.Background()); empty || err != nil || g.queue.Len() != 4 {
+		t.Fatalf("expect a batch refreshed, but empty: %v, error: %v", empty, err)
+	}
+	if v, _ := g.mainCache.peek("f"); v.String() != "f" {
+		t.Fatalf("expect the batch cached, but %q got", v)
+	}
+
+	// batches stop short of a key taking them past their symbols
+	multi := NewGroup("leased-symbols", 2<<10, nil, GroupWithProvider(NewSinaProvider()), GroupWithBatch(3, time.Millisecond*20))
+	for _, key := range []string{"sh600000,sz000001", "sz000002,sz000003", "sz000004"} {
+		multi.SendMissedCache(key)
+	}
+	for _, expect := range []int{1, 2} {
+		if leases := multi.LeaseBatch("", 0); len(leases) != expect {
+			t.Fatalf("expect a batch of %d keys, but %+v got", expect, leases)
+		}
+	}
+}
@@ -1,22 +1,49 @@
 package cache
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"golang.org/x/sync/singleflight"
 	"os"
+	"sort"
 	"stock_data_cache/utils"
 	"sync"
 	"time"
 )
 
 const MissedChanLen = 5000
-const MissedCacheApi = "http://api.gushenpai.com:7295/cache/sina?missed=1"
-const UpdateCacheApi = "http://api.gushenpai.com:7295/cache/sina"
 const FilePath = "/tmp/cache.gob"
+const QueueFilePath = "/tmp/cache_queue.log"
 const ExpireMinutes = 30
+const FetchTimeout = time.Second * 5
+
+// SnapshotVersion is the format of the snapshots SaveCache writes, see
+// LoadCache for the ones it reads: version 1 held a map of values, version 2
+// the entries in LRU order with their metadata.
+const SnapshotVersion = 2
+
+var (
+	// ErrStaleVersion is a write older than the cached value
+	ErrStaleVersion = errors.New("stale version")
+	// ErrVersionMismatch is a compare-and-set write whose expected version
+	// isn't the cached one
+	ErrVersionMismatch = errors.New("version mismatch")
+)
+
+// A RejectedError is an update whose value failed the sanity checks, see
+// Group.checkValue.
+type RejectedError struct {
+	Err error
+}
+
+func (e *RejectedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RejectedError) Unwrap() error {
+	return e.Err
+}
 
 // A ByteView holds an immutable view of bytes.
 type ByteView struct {
@@ -47,29 +74,159 @@ func cloneBytes(b []byte) []byte {
 type cache struct {
 	mu         sync.Mutex
 	lru        *Cache
-	missedChan chan string
 	cacheBytes int64
 }
 
-func (c *cache) add(key string, value ByteView) {
+// add adds value fetched at timestamp unless the cached value of key has a
+// newer version.
+func (c *cache) add(key string, value ByteView, version int64, timestamp time.Time) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.lru == nil {
 		c.lru = New(c.cacheBytes, nil)
 	}
-	c.lru.Add(key, value)
+	if current, ok := c.lru.Version(key); ok && version < current {
+		return fmt.Errorf("%w: %d, cached: %d", ErrStaleVersion, version, current)
+	}
+	c.lru.addAt(key, value, version, timestamp)
+	return nil
 }
 
-func (c *cache) get(key string) (value ByteView, ok bool) {
+// compareAndSwap adds value fetched at timestamp only if the cached value of
+// key has version expected, 0 meaning key isn't cached.
+func (c *cache) compareAndSwap(key string, value ByteView, expected, version int64, timestamp time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lru == nil {
+		c.lru = New(c.cacheBytes, nil)
+	}
+	if current, _ := c.lru.Version(key); current != expected {
+		return fmt.Errorf("%w: expected %d, cached: %d", ErrVersionMismatch, expected, current)
+	}
+	c.lru.addAt(key, value, version, timestamp)
+	return nil
+}
+
+// retain removes the keys not in keep, it returns the number removed.
+func (c *cache) retain(keep map[string]bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lru == nil {
+		return 0
+	}
+	removed := make([]string, 0)
+	for key := range c.lru.cache {
+		if !keep[key] {
+			removed = append(removed, key)
+		}
+	}
+	for _, key := range removed {
+		c.lru.Remove(key)
+	}
+	return len(removed)
+}
+
+// remove removes key, it reports whether it was cached.
+func (c *cache) remove(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lru == nil {
+		return false
+	}
+	return c.lru.Remove(key)
+}
+
+// version returns the version of the cached value of key.
+func (c *cache) version(key string) (version int64, ok bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if c.lru == nil {
 		return
 	}
+	return c.lru.Version(key)
+}
 
-	if v, ok := c.lru.Get(key); ok {
+// peek looks up a key's value without marking it as recently used.
+func (c *cache) peek(key string) (value ByteView, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lru == nil {
+		return
+	}
+	if v, ok := c.lru.Peek(key); ok {
 		return v.(ByteView), ok
 	}
+	return
+}
+
+// usage returns when a key's value was cached and how it was looked up,
+// without marking it as recently used.
+func (c *cache) usage(key string) (timestamp time.Time, hits int64, accessed time.Time, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lru == nil {
+		return
+	}
+	if hits, accessed, ok = c.lru.Usage(key); ok {
+		timestamp, _ = c.lru.Timestamp(key)
+	}
+	return
+}
+
+// snapshot returns the cached entries from the most recently used to the
+// least.
+func (c *cache) snapshot() []snapshotEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lru == nil {
+		return nil
+	}
+	entries := make([]snapshotEntry, 0, c.lru.Len())
+	for ele := c.lru.ll.Front(); ele != nil; ele = ele.Next() {
+		kv := ele.Value.(*entry)
+		entries = append(entries, snapshotEntry{
+			Key:       kv.key,
+			Value:     kv.value.(ByteView).b,
+			Timestamp: kv.timestamp,
+			Version:   kv.version,
+			Hits:      kv.hits,
+			Accessed:  kv.accessed,
+		})
+	}
+	return entries
+}
+
+// restore adds the entries of a snapshot behind the cached ones, keeping
+// their order and metadata.
+func (c *cache) restore(entries []snapshotEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lru == nil {
+		c.lru = New(c.cacheBytes, nil)
+	}
+	for _, e := range entries {
+		c.lru.restore(&entry{
+			key:       e.Key,
+			value:     ByteView{b: e.Value},
+			timestamp: e.Timestamp,
+			version:   e.Version,
+			hits:      e.Hits,
+			accessed:  e.Accessed,
+		})
+	}
+}
+
+func (c *cache) get(key string) (value ByteView, timestamp time.Time, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lru == nil {
+		return
+	}
+
+	if v, ok := c.lru.Get(key); ok {
+		timestamp, _ = c.lru.Timestamp(key)
+		return v.(ByteView), timestamp, ok
+	}
 
 	return
 }
@@ -78,8 +235,29 @@ func (c *cache) get(key string) (value ByteView, ok bool) {
 type Group struct {
 	name      string
 	getter    Getter
-	mainCache cache
-	sg        *singleflight.Group
+	provider  Provider
+	fallbacks []Provider
+	workers   int
+	calendar  *Calendar
+	mode      Mode
+	peers     PeerPicker
+	queue     *WorkQueue
+	// batchSymbols and batchWindow bound the batches of keys fetched at once
+	batchSymbols int
+	batchWindow  time.Duration
+	mainCache    cache
+	sg           *singleflight.Group
+}
+
+// A GroupOption configures a Group.
+type GroupOption func(*Group)
+
+// GroupWithProvider makes the group fetch its values from provider instead
+// of its getter.
+func GroupWithProvider(provider Provider) GroupOption {
+	return func(g *Group) {
+		g.provider = provider
+	}
 }
 
 // A Getter loads data for a key.
@@ -100,19 +278,47 @@ var (
 	groups = make(map[string]*Group)
 )
 
-// NewGroup create a new instance of Group
-func NewGroup(name string, cacheBytes int64, getter Getter) *Group {
-	if getter == nil {
+// GroupWithCalendar makes the group's quotes expire according to the trading
+// hours of their markets instead of after ExpireMinutes.
+func GroupWithCalendar(calendar *Calendar) GroupOption {
+	return func(g *Group) {
+		g.calendar = calendar
+	}
+}
+
+// GroupWithQueue configures the group's queue of keys to refresh instead of
+// using DefaultQueueConfig.
+func GroupWithQueue(config QueueConfig) GroupOption {
+	return func(g *Group) {
+		g.queue = NewWorkQueue(config)
+	}
+}
+
+// NewGroup create a new instance of Group, getter may be nil if a provider
+// is given.
+func NewGroup(name string, cacheBytes int64, getter Getter, opts ...GroupOption) *Group {
+	g := &Group{
+		name:         name,
+		getter:       getter,
+		mainCache:    cache{cacheBytes: cacheBytes},
+		sg:           &singleflight.Group{},
+		workers:      DefaultWorkers,
+		mode:         ModeStandalone,
+		queue:        NewWorkQueue(DefaultQueueConfig),
+		batchSymbols: DefaultBatchSymbols,
+		batchWindow:  DefaultBatchWindow,
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	if g.getter == nil && g.provider == nil {
 		panic("nil Getter")
 	}
+	g.queue.onExpired = func(lease Lease) {
+		slaves.failed(lease.Owner)
+	}
 	mu.Lock()
 	defer mu.Unlock()
-	g := &Group{
-		name:      name,
-		getter:    getter,
-		mainCache: cache{cacheBytes: cacheBytes},
-		sg:        &singleflight.Group{},
-	}
 	groups[name] = g
 	return g
 }
@@ -126,23 +332,43 @@ func GetGroup(name string) *Group {
 	return g
 }
 
-// Get value for a key from cache
+// Get value for a key from cache, or from the peer owning it
 func (g *Group) Get(key string) (ByteView, error) {
+	return g.get(key, true)
+}
+
+// get looks key up in the cache, and unless it is cached loads it from its
+// owner if routed, or locally. Requests from peers aren't routed again, so
+// peers with different rings can't forward keys in circles.
+func (g *Group) get(key string, routed bool) (ByteView, error) {
 	if key == "" {
 		return ByteView{}, fmt.Errorf("key is required")
 	}
 
-	if v, ok := g.mainCache.get(key); ok {
+	if v, timestamp, ok := g.mainCache.get(key); ok {
 		fmt.Printf("cache hit, key: %s\n", key)
+		if g.expired(key, timestamp) {
+			fmt.Printf("cache timeout, key: %s\n", key)
+			g.enqueue(key, PriorityStale)
+		}
 		return v, nil
 	}
 
 	fmt.Printf("cache miss, key: %s\n", key)
-	return g.load(key)
+	return g.load(key, routed)
 }
 
-func (g *Group) load(key string) (value ByteView, err error) {
+func (g *Group) load(key string, routed bool) (value ByteView, err error) {
 	v, err, _ := g.sg.Do(key, func() (interface{}, error) {
+		if routed && g.peers != nil {
+			if peer, ok := g.peers.PickPeer(key); ok {
+				value, err := g.getFromPeer(peer, key)
+				if err == nil {
+					return value, nil
+				}
+				fmt.Printf("get from peer failed, group: %s, key: %s, error: %s\n", g.name, key, err.Error())
+			}
+		}
 		return g.getLocally(key)
 	})
 
@@ -152,31 +378,132 @@ func (g *Group) load(key string) (value ByteView, err error) {
 	return
 }
 
+// getLocally fetches a key that isn't cached, or only queues it for the
+// slaves of a master. Replicas of a master ask their primary instead, whose
+// slaves refresh the key for it to be replicated.
 func (g *Group) getLocally(key string) (ByteView, error) {
-	//b, err := g.getter.Get(key)
-	//if err != nil {
-	//	if g.mainCache.missedChan == nil {
-	//		g.mainCache.missedChan = make(chan string, MissedChanLen)
-	//	}
-	//	select {
-	//	case g.mainCache.missedChan <- key:
-	//	default:
-	//	}
-	//	return ByteView{}, err
-	//}
-	//value := ByteView{b: cloneBytes(b)}
-	//g.populateCache(key, value)
-	//return value, nil
-
-	g.SendMissedCache(key)
-	return ByteView{}, errors.New("no data")
-}
-
-func (g *Group) populateCache(key string, value ByteView) {
-	g.mainCache.add(key, value)
-}
-
-func (g *Group) UpdateCache(num, minutes int) {
+	if g.mode == ModeMaster {
+		if primary := Primary(); primary != "" {
+			return g.getFromPeer(&httpGetter{baseURL: primary + defaultBasePath}, key)
+		}
+		g.SendMissedCache(key)
+		return ByteView{}, errors.New("no data")
+	}
+
+	fetchedAt := time.Now()
+	b, err := g.fetch(context.Background(), key)
+	if err != nil {
+		return ByteView{}, err
+	}
+	value := ByteView{b: cloneBytes(b)}
+	if err := g.populateCache(key, value, fetchedAt.UnixNano()); err != nil {
+		var rejected *RejectedError
+		if errors.As(err, &rejected) && !errors.Is(err, ErrOutdated) {
+			return ByteView{}, err
+		}
+		fmt.Printf("populate cache failed, group: %s, key: %s, error: %s\n", g.name, key, err.Error())
+	}
+	return value, nil
+}
+
+// expired reports whether the value of key added at timestamp is stale.
+func (g *Group) expired(key string, timestamp time.Time) bool {
+	if g.calendar != nil {
+		if market := marketOf(key); market != "" {
+			return !time.Now().Before(g.calendar.Expiry(market, timestamp))
+		}
+	}
+	return int(time.Now().Sub(timestamp).Minutes()) >= ExpireMinutes
+}
+
+// populateCache caches value for key unless it fails the sanity checks,
+// with a RejectedError, or a newer version is cached. Versions are the unix
+// nanoseconds the value was fetched at, or the latest it can have been,
+// quote times are compared by the sanity checks instead.
+func (g *Group) populateCache(key string, value ByteView, version int64) error {
+	if err := g.reject(key, value); err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := g.mainCache.add(key, value, version, now); err != nil {
+		metrics.Inc("update_conflict_total", "group", g.name)
+		return err
+	}
+	replicate(ReplicationOp{Op: OpSet, Group: g.name, Key: key, Value: value.String(), Version: version, Timestamp: now.UnixNano()})
+	return nil
+}
+
+// compareAndSwap caches value for key only if the cached version is
+// expected, see cache.compareAndSwap, and it passes the sanity checks.
+func (g *Group) compareAndSwap(key string, value ByteView, expected, version int64) error {
+	if err := g.reject(key, value); err != nil {
+		return err
+	}
+	now := time.Now()
+	if err := g.mainCache.compareAndSwap(key, value, expected, version, now); err != nil {
+		metrics.Inc("update_conflict_total", "group", g.name)
+		return err
+	}
+	replicate(ReplicationOp{Op: OpSet, Group: g.name, Key: key, Value: value.String(), Version: version, Timestamp: now.UnixNano()})
+	return nil
+}
+
+// reject returns a RejectedError if value fails the sanity checks for key,
+// see checkValue, and counts it.
+func (g *Group) reject(key string, value ByteView) error {
+	err := g.checkValue(key, value.ByteSlice())
+	if err == nil {
+		return nil
+	}
+	fmt.Printf("update cache rejected, group: %s, key: %s, error: %s\n", g.name, key, err.Error())
+	reason := "invalid"
+	var payloadErr *PayloadError
+	if errors.As(err, &payloadErr) {
+		reason = payloadErr.Kind.Error()
+	}
+	metrics.Inc("update_rejected_total", "group", g.name, "reason", reason)
+	return &RejectedError{Err: err}
+}
+
+// Invalidate removes key from the cache, it reports whether it was cached.
+func (g *Group) Invalidate(key string) bool {
+	ok := g.mainCache.remove(key)
+	replicate(ReplicationOp{Op: OpDelete, Group: g.name, Key: key})
+	return ok
+}
+
+// Provider returns the group's provider, or nil if it uses a getter.
+func (g *Group) Provider() Provider {
+	return g.provider
+}
+
+// available reports whether any of the group's upstream hosts accepts
+// requests, groups using a getter are always available.
+func (g *Group) available() bool {
+	if g.provider == nil {
+		return true
+	}
+	for _, p := range g.candidates() {
+		if Available(p.Host()) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetch requests the latest value of key from the group's providers, or from
+// its getter if it has none. Upstream requests are aborted once ctx is done,
+// getters can't be.
+func (g *Group) fetch(ctx context.Context, key string) ([]byte, error) {
+	if g.provider == nil {
+		return g.getter.Get(key)
+	}
+	return g.fetchWithFailover(ctx, key)
+}
+
+// UpdateCache refreshes up to num keys last updated at least minutes ago, see
+// GroupWithWorkers for its concurrency.
+func (g *Group) UpdateCache(ctx context.Context, num, minutes int) UpdateResult {
 	defer utils.TimeTrack(time.Now(), "UpdateCache")
 
 	keys := make([]string, 0)
@@ -206,102 +533,132 @@ func (g *Group) UpdateCache(num, minutes int) {
 	}
 	g.mainCache.mu.Unlock()
 
-	var succeed int
-	for _, key := range keys {
-		time.Sleep(time.Millisecond * 100)
-		v, err := RequestSina(key, time.Second*5)
-		if err != nil {
-			fmt.Printf("request sina failed, error: %s\n", err.Error())
-			continue
-		}
-		value := ByteView{b: cloneBytes([]byte(v))}
-		g.mainCache.add(key, value)
-		succeed++
-	}
-	fmt.Printf("update cache done, total: %d, succeed: %d\n", len(keys), succeed)
+	result := g.refresh(ctx, keys)
+	fmt.Printf("update cache done, group: %s, %s\n", g.name, result)
+	return result
 }
 
+// SaveCache writes the group's entries to a snapshot at FilePath, with the
+// time each value was fetched, its version and usage, in LRU order.
 func (g *Group) SaveCache() {
-	kvs := make(map[string]string)
-
-	g.mainCache.mu.Lock()
-	if g.mainCache.lru == nil {
-		g.mainCache.lru = New(g.mainCache.cacheBytes, nil)
-	}
-
-	ele := g.mainCache.lru.ll.Front()
-	for {
-		if ele == nil {
-			break
-		}
-		kvs[ele.Value.(*entry).key] = string(ele.Value.(*entry).value.(ByteView).ByteSlice())
-		if ele == g.mainCache.lru.ll.Back() {
-			break
-		}
-		ele = ele.Next()
-	}
-	g.mainCache.mu.Unlock()
-
-	if err := utils.Save(FilePath, kvs); err != nil {
+	entries := g.mainCache.snapshot()
+	if err := utils.SaveSnapshot(FilePath, SnapshotVersion, len(entries), entries); err != nil {
 		fmt.Printf("save cache failed, error: %s\n", err.Error())
 		return
 	}
-	fmt.Printf("save cache done, key number: %d\n", len(kvs))
+	fmt.Printf("save cache done, key number: %d\n", len(entries))
 }
 
+// LoadCache caches the entries of the snapshot SaveCache wrote, as fresh or
+// stale as they were and in the same LRU order. Snapshots failing their
+// checks are moved aside to FilePath.corrupt. Files of older formats, the
+// plain gob map written before snapshots had a header included, are read and
+// rewritten in the current one.
 func (g *Group) LoadCache() {
 	if _, err := os.Stat(FilePath); os.IsNotExist(err) {
 		fmt.Printf("file not exist, file: %s\n", FilePath)
 		return
 	}
 
-	kvs := make(map[string]string)
-	if err := utils.Load(FilePath, &kvs); err != nil {
+	entries, migrate, err := g.loadSnapshot(FilePath)
+	if err != nil {
 		fmt.Printf("load cache failed, error: %s\n", err.Error())
+		// keep the file to look into, the next save would replace it
+		if err := os.Rename(FilePath, FilePath+".corrupt"); err != nil {
+			fmt.Printf("move corrupt cache file failed, error: %s\n", err.Error())
+		}
 		return
 	}
+	g.mainCache.restore(entries)
 
-	for k, v := range kvs {
-		g.mainCache.add(k, ByteView{b: cloneBytes([]byte(v))})
+	fmt.Printf("load cache done, key number: %d\n", len(entries))
+	if migrate {
+		fmt.Printf("migrate cache file, file: %s, version: %d\n", FilePath, SnapshotVersion)
+		g.SaveCache()
 	}
+}
 
-	fmt.Printf("load cache done, key number: %d\n", len(kvs))
+// A snapshotEntry is a cached value with its metadata, see SaveCache.
+type snapshotEntry struct {
+	Key       string
+	Value     []byte
+	Timestamp time.Time
+	Version   int64
+	Hits      int64
+	Accessed  time.Time
 }
 
-func (g *Group) RemoteUpdateCache() (empty bool, err error) {
-	b, err := utils.DoGetRequest(MissedCacheApi, time.Second*5)
+// loadSnapshot reads the entries of the snapshot at path, checking its
+// version and count. migrate reports a file of an older format: the values
+// of version 1 snapshots and plain gob maps have no metadata, see
+// legacyEntries.
+func (g *Group) loadSnapshot(path string) (entries []snapshotEntry, migrate bool, err error) {
+	kvs := make(map[string]string)
+	header, err := utils.LoadSnapshot(path, func(header utils.SnapshotHeader) (interface{}, error) {
+		switch header.Version {
+		case 1:
+			return &kvs, nil
+		case SnapshotVersion:
+			return &entries, nil
+		}
+		return nil, fmt.Errorf("unsupported snapshot version: %d", header.Version)
+	})
+	if errors.Is(err, utils.ErrNotSnapshot) {
+		if err := utils.Load(path, &kvs); err != nil {
+			return nil, false, err
+		}
+		return g.legacyEntries(path, kvs), true, nil
+	}
 	if err != nil {
-		fmt.Printf("request get missed failed, error: %s\n", err.Error())
-		return
+		return nil, false, err
+	}
+	migrate = header.Version != SnapshotVersion
+	if migrate {
+		entries = g.legacyEntries(path, kvs)
+	}
+	if header.Count != uint64(len(entries)) {
+		return nil, false, fmt.Errorf("snapshot count mismatch, count: %d, expect: %d", len(entries), header.Count)
 	}
+	return entries, migrate, nil
+}
 
-	key := string(b)
-	if key == "" {
-		fmt.Println("no missed")
-		empty = true
-		return
+// legacyEntries returns the entries of the values of an older file at path:
+// they are timestamped with the time the file was written, the latest they
+// can have been fetched at, so that old quotes don't look fresh, and come in
+// no particular order.
+func (g *Group) legacyEntries(path string, kvs map[string]string) []snapshotEntry {
+	timestamp := time.Now()
+	if info, err := os.Stat(path); err == nil {
+		timestamp = info.ModTime()
 	}
+	entries := make([]snapshotEntry, 0, len(kvs))
+	for k, v := range kvs {
+		entries = append(entries, snapshotEntry{Key: k, Value: []byte(v), Timestamp: timestamp, Version: timestamp.UnixNano()})
+	}
+	return entries
+}
 
-	value, err := RequestSina(key, time.Second*5)
-	if err != nil {
-		fmt.Printf("request sina failed, error: %s\n", err.Error())
+// LoadQueue queues the keys of the group's queue file at path again, e.g.
+// the ones left after a restart, and keeps the queued keys in it from now on.
+func (g *Group) LoadQueue(path string) {
+	if err := g.queue.Open(path); err != nil {
+		fmt.Printf("load queue failed, error: %s\n", err.Error())
 		return
 	}
+	fmt.Printf("load queue done, key number: %d\n", g.queue.Len())
+}
 
-	req := UpdateCacheRequest{
-		Key:   key,
-		Value: value,
-	}
-	b, _ = json.Marshal(req)
-	if _, err = utils.DoPostRequest(UpdateCacheApi, time.Second*5, bytes.NewBuffer(b)); err != nil {
-		fmt.Printf("request update cache failed, error: %s\n", err.Error())
+// CompactQueue drops the keys that left the group's queue from its file.
+func (g *Group) CompactQueue() {
+	if err := g.queue.Compact(); err != nil {
+		fmt.Printf("compact queue failed, error: %s\n", err.Error())
 	}
-	fmt.Printf("request update cache succeed, key: %s, value: %s\n", key, value)
-	return
 }
 
+// SendTimeoutCache queues up to num expired keys in the background class,
+// the most looked up and most recently looked up ones first.
 func (g *Group) SendTimeoutCache(num int) {
-	keys := make([]string, 0)
+	entries := make([]entry, 0)
 
 	g.mainCache.mu.Lock()
 	if g.mainCache.lru == nil {
@@ -315,36 +672,135 @@ func (g *Group) SendTimeoutCache(num int) {
 		}
 		kv := ele.Value.(*entry)
 		// Only update caches that have timed out
-		if int(time.Now().Sub(kv.timestamp).Minutes()) >= ExpireMinutes {
-			keys = append(keys, kv.key)
+		if g.expired(kv.key, kv.timestamp) {
+			entries = append(entries, *kv)
 		}
 		if ele == g.mainCache.lru.ll.Back() {
 			break
 		}
-		if len(keys) == num {
+		if len(entries) == num {
 			break
 		}
 		ele = ele.Next()
 	}
 	g.mainCache.mu.Unlock()
 
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].hits != entries[j].hits {
+			return entries[i].hits > entries[j].hits
+		}
+		return entries[i].accessed.After(entries[j].accessed)
+	})
 	var succeed int
-	for _, key := range keys {
-		select {
-		case g.mainCache.missedChan <- key:
+	for _, kv := range entries {
+		if g.enqueue(kv.key, PriorityBackground) {
 			succeed++
-		default:
 		}
 	}
-	fmt.Printf("send timeout cache done, total: %d, succeed: %d\n", len(keys), succeed)
+	fmt.Printf("send timeout cache done, total: %d, succeed: %d\n", len(entries), succeed)
 }
 
+// SendMissedCache queues a key that isn't cached to be refreshed before any
+// other, see LeaseMissed.
 func (g *Group) SendMissedCache(key string) {
-	if g.mainCache.missedChan == nil {
-		g.mainCache.missedChan = make(chan string, MissedChanLen)
-	}
-	select {
-	case g.mainCache.missedChan <- key:
+	g.enqueue(key, PriorityMiss)
+}
+
+// enqueue queues key with priority, it returns false if key wasn't queued.
+func (g *Group) enqueue(key string, priority Priority) bool {
+	switch err := g.queue.Enqueue(key, priority); err {
+	case nil:
+		return true
+	case ErrQuarantined:
+		fmt.Printf("missed key quarantined, group: %s, key: %s\n", g.name, key)
 	default:
+		metrics.Inc("missed_dropped_total", "group", g.name, "priority", priority.String())
+		fmt.Printf("missed queue full, group: %s, key: %s\n", g.name, key)
+	}
+	return false
+}
+
+// LeaseMissed leases the next key to refresh to slave, it is queued again
+// after the queue's visibility timeout unless an update acknowledges the
+// lease, or at once if the slave dies.
+func (g *Group) LeaseMissed(slave string) (Lease, bool) {
+	reapSlaves()
+	return g.queue.Lease(slave)
+}
+
+// QueueStats returns a snapshot of the group's queue of keys to refresh.
+func (g *Group) QueueStats() QueueStats {
+	return g.queue.Stats()
+}
+
+// ack acknowledges the lease with token, or every lease of key for updates
+// without a token, and returns the leases acknowledged.
+func (g *Group) ack(key, token string) []Lease {
+	if token != "" {
+		lease, ok := g.queue.Ack(token)
+		if !ok {
+			fmt.Printf("unknown lease, group: %s, key: %s\n", g.name, key)
+			return nil
+		}
+		return []Lease{lease}
+	}
+	return g.queue.AckKey(key)
+}
+
+// update makes an update sent by a slave or an admin, acknowledges its lease
+// and records the slave's stats. It returns the version cached, rejected
+// values fail with a RejectedError and outdated ones with ErrStaleVersion or
+// ErrVersionMismatch. The lease of an update superseded by a newer cached
+// value is acknowledged too, the key is as fresh as it gets.
+func (g *Group) update(params UpdateCacheRequest) (int64, error) {
+	version := params.Version
+	if version == 0 {
+		// it was fetched before it was sent
+		version = time.Now().UnixNano()
+	}
+	value := ByteView{b: cloneBytes([]byte(params.Value))}
+	var err error
+	if params.ExpectedVersion != nil {
+		err = g.compareAndSwap(params.Key, value, *params.ExpectedVersion, version)
+	} else {
+		err = g.populateCache(params.Key, value, version)
+	}
+	var rejected *RejectedError
+	if errors.As(err, &rejected) {
+		if errors.Is(err, ErrOutdated) {
+			// a newer quote is cached already
+			g.acked(params)
+		} else if params.Lease != "" {
+			// the key is retried with backoff like a failed fetch
+			g.nack(newNack(Lease{Key: params.Key, Token: params.Lease}, params.Slave, rejected))
+		} else {
+			slaves.failed(params.Slave)
+		}
+		return 0, err
+	}
+	if errors.Is(err, ErrStaleVersion) {
+		// a newer value is cached already, the slave did its job
+		fmt.Printf("update cache superseded, key: %s, error: %s\n", params.Key, err.Error())
+		g.acked(params)
+		return 0, err
+	}
+	if err != nil {
+		fmt.Printf("update cache conflict, key: %s, error: %s\n", params.Key, err.Error())
+		slaves.failed(params.Slave)
+		return 0, err
+	}
+	g.acked(params)
+	fmt.Printf("update cache succeed, key: %s, value: %s\n", params.Key, params.Value)
+	return version, nil
+}
+
+// acked acknowledges the lease of an update and records the slave's success.
+func (g *Group) acked(params UpdateCacheRequest) {
+	var latency time.Duration
+	for _, lease := range g.ack(params.Key, params.Lease) {
+		if lease.Owner == params.Slave {
+			latency = time.Since(lease.Leased)
+		}
 	}
+	slaves.succeeded(params.Slave, latency)
 }
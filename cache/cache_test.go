@@ -1,10 +1,17 @@
 package cache
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
+	"os"
+	"path/filepath"
 	"reflect"
+	"stock_data_cache/utils"
 	"testing"
+	"time"
 )
 
 var db = map[string]string{
@@ -65,3 +72,153 @@ func TestGetGroup(t *testing.T) {
 		t.Fatalf("expect nil, but %s got", group.name)
 	}
 }
+
+func TestPopulateCacheVersion(t *testing.T) {
+	g := NewGroup("versions", 2<<10, GetterFunc(
+		func(key string) (bytes []byte, err error) { return }))
+	if err := g.populateCache("key", ByteView{b: []byte("new")}, 2); err != nil {
+		t.Fatalf("populate failed, error: %s", err.Error())
+	}
+	if err := g.populateCache("key", ByteView{b: []byte("old")}, 1); !errors.Is(err, ErrStaleVersion) {
+		t.Fatalf("expect older version to be rejected, but %v got", err)
+	}
+	if v, _ := g.mainCache.peek("key"); v.String() != "new" {
+		t.Fatalf("expect new value to be kept, but %s got", v)
+	}
+
+	p := NewHTTPPool("localhost")
+	stale := UpdateCacheRequest{Key: "key", Value: "stale", Version: 1}
+	if code := postRequest(p, "versions", stale); code != http.StatusConflict {
+		t.Fatalf("expect stale update to conflict, but %d got", code)
+	}
+	expected := int64(1)
+	cas := UpdateCacheRequest{Key: "key", Value: "admin", Version: 3, ExpectedVersion: &expected}
+	if code := postRequest(p, "versions", cas); code != http.StatusConflict {
+		t.Fatalf("expect mismatched compare-and-set to conflict, but %d got", code)
+	}
+	expected = 2
+	if code := postRequest(p, "versions", cas); code != http.StatusOK {
+		t.Fatalf("expect compare-and-set to succeed, but %d got", code)
+	}
+	if version, _ := g.mainCache.version("key"); version != 3 {
+		t.Fatalf("expect version 3, but %d got", version)
+	}
+}
+
+func TestUpdateVersionClock(t *testing.T) {
+	sina := NewSinaProvider()
+	g := NewGroup("clock", 2<<10, nil, GroupWithProvider(sina))
+	value := sina.Format([]Quote{testQuote})
+	_ = g.populateCache("sz000001", ByteView{b: value}, time.Now().UnixNano())
+	// versioned by when it was received, not by its quote time long before
+	if code := postUpdate(NewHTTPPool("localhost"), "clock", "sz000001", value); code != http.StatusOK {
+		t.Fatalf("expect an update without version to supersede the fetched value, but %d got", code)
+	}
+}
+
+func TestUpdateSuperseded(t *testing.T) {
+	g := NewGroup("superseded", 2<<10, GetterFunc(func(key string) ([]byte, error) { return nil, nil }),
+		GroupWithMode(ModeMaster))
+	_ = g.populateCache("key", ByteView{b: []byte("new")}, 2)
+	defer func(r *SlaveRegistry) { slaves = r }(slaves)
+	slaves = NewSlaveRegistry(time.Minute)
+	slaves.Register("superseding", nil)
+	g.SendMissedCache("key")
+	lease, _ := g.LeaseMissed("superseding")
+	if _, err := g.update(UpdateCacheRequest{Key: "key", Value: "old", Version: 1, Lease: lease.Token, Slave: "superseding"}); !errors.Is(err, ErrStaleVersion) {
+		t.Fatalf("expect a stale version, but %v got", err)
+	}
+	if g.queue.Len() != 0 {
+		t.Fatalf("expect the lease of a superseded update to be acknowledged, but %+v got", g.queue.State("key"))
+	}
+	for _, s := range slaves.Stats() {
+		if s.ID == "superseding" && (s.Failed != 0 || s.Fetched != 1) {
+			t.Fatalf("expect a superseded update not to count as a failure, but %+v got", s)
+		}
+	}
+}
+
+func TestLoadSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	g := NewGroup("snapshot", 2<<10, GetterFunc(func(key string) ([]byte, error) { return nil, nil }))
+	fetched := time.Now().Add(-time.Hour * 24)
+	for i, key := range []string{"cold", "warm", "hot"} {
+		_ = g.populateCache(key, ByteView{b: []byte(key)}, int64(i+1))
+	}
+	g.mainCache.get("warm")
+	g.mainCache.get("hot")
+	g.mainCache.get("hot")
+	g.mainCache.lru.cache["cold"].Value.(*entry).timestamp = fetched
+	entries := g.mainCache.snapshot()
+
+	path := filepath.Join(dir, "cache.gob")
+	if err := utils.SaveSnapshot(path, SnapshotVersion, len(entries), entries); err != nil {
+		t.Fatalf("save snapshot failed, error: %s", err.Error())
+	}
+	restored := NewGroup("restored", 2<<10, GetterFunc(func(key string) ([]byte, error) { return nil, nil }))
+	got, migrate, err := restored.loadSnapshot(path)
+	if err != nil || migrate || len(got) != 3 {
+		t.Fatalf("expect snapshot to be loaded, but %v %v %v got", got, migrate, err)
+	}
+	restored.mainCache.restore(got)
+	keys := make([]string, 0)
+	for ele := restored.mainCache.lru.ll.Front(); ele != nil; ele = ele.Next() {
+		keys = append(keys, ele.Value.(*entry).key)
+	}
+	if !reflect.DeepEqual(keys, []string{"hot", "warm", "cold"}) {
+		t.Fatalf("expect LRU order to be kept, but %v got", keys)
+	}
+	timestamp, hits, _, _ := restored.mainCache.usage("cold")
+	if !timestamp.Equal(fetched) || !restored.expired("cold", timestamp) {
+		t.Fatalf("expect cold to stay stale, but fetched at %s", timestamp)
+	}
+	if _, hits, _, _ = restored.mainCache.usage("hot"); hits != 2 {
+		t.Fatalf("expect hits to be kept, but %d got", hits)
+	}
+	if version, _ := restored.mainCache.version("warm"); version != 2 {
+		t.Fatalf("expect version to be kept, but %d got", version)
+	}
+	b, _ := ioutil.ReadFile(path)
+
+	// older formats are migrated, timestamped with the file
+	kvs := map[string]string{"sh600000": "a", "sz000001": "b"}
+	written := time.Now().Add(-time.Hour)
+	for name, save := range map[string]func(string) error{
+		"v1.gob":     func(path string) error { return utils.SaveSnapshot(path, 1, len(kvs), kvs) },
+		"legacy.gob": func(path string) error { return utils.Save(path, kvs) },
+	} {
+		path := filepath.Join(dir, name)
+		_ = save(path)
+		_ = os.Chtimes(path, written, written)
+		got, migrate, err := g.loadSnapshot(path)
+		if err != nil || !migrate || len(got) != 2 || !got[0].Timestamp.Equal(written) {
+			t.Fatalf("expect %s to be migrated, but %v %v %v got", name, got, migrate, err)
+		}
+	}
+
+	corrupt := func(name string, b []byte) error {
+		p := filepath.Join(dir, name)
+		_ = ioutil.WriteFile(p, b, 0644)
+		_, _, err := g.loadSnapshot(p)
+		return err
+	}
+	if err := corrupt("truncated", b[:len(b)-1]); err == nil {
+		t.Fatal("expect truncated snapshot to fail")
+	}
+	flipped := append([]byte(nil), b...)
+	flipped[len(flipped)-2] ^= 0xff
+	if err := corrupt("flipped", flipped); !errors.Is(err, utils.ErrChecksum) {
+		t.Fatalf("expect checksum mismatch, but %v got", err)
+	}
+
+	newer := filepath.Join(dir, "newer.gob")
+	_ = utils.SaveSnapshot(newer, SnapshotVersion+1, len(entries), entries)
+	if _, _, err := g.loadSnapshot(newer); err == nil {
+		t.Fatal("expect unknown version to fail")
+	}
+	miscounted := filepath.Join(dir, "miscounted.gob")
+	_ = utils.SaveSnapshot(miscounted, SnapshotVersion, len(entries)+1, entries)
+	if _, _, err := g.loadSnapshot(miscounted); err == nil {
+		t.Fatal("expect count mismatch to fail")
+	}
+}
@@ -0,0 +1,227 @@
+package cache
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MarketCN = "cn" // shanghai, shenzhen and beijing
+	MarketHK = "hk"
+	MarketUS = "us"
+)
+
+const DefaultSessionTTL = time.Minute
+
+// closeGrace is how long after a session closes quotes may still change,
+// e.g. while closing auctions are settled.
+const closeGrace = time.Minute * 5
+
+//go:embed holidays.json
+var defaultHolidays []byte
+
+// A Session is a continuous trading period, in minutes since midnight.
+type Session struct {
+	Open  int
+	Close int
+}
+
+// A Market is an exchange's trading hours in its own time zone.
+type Market struct {
+	Name     string
+	Location *time.Location
+	Sessions []Session
+	holidays map[string]bool
+}
+
+// IsTradingDay reports whether t's date in the market's time zone is a
+// weekday that isn't a holiday.
+func (m *Market) IsTradingDay(t time.Time) bool {
+	t = t.In(m.Location)
+	if t.Weekday() == time.Saturday || t.Weekday() == time.Sunday {
+		return false
+	}
+	return !m.holidays[t.Format("2006-01-02")]
+}
+
+// IsOpen reports whether the market is trading at t.
+func (m *Market) IsOpen(t time.Time) bool {
+	return m.session(t) != nil
+}
+
+// session returns the session the market is trading in at t, if any.
+func (m *Market) session(t time.Time) *Session {
+	if !m.IsTradingDay(t) {
+		return nil
+	}
+	t = t.In(m.Location)
+	minute := t.Hour()*60 + t.Minute()
+	for i := range m.Sessions {
+		if minute >= m.Sessions[i].Open && minute < m.Sessions[i].Close {
+			return &m.Sessions[i]
+		}
+	}
+	return nil
+}
+
+// NextOpen returns the first session open after t.
+func (m *Market) NextOpen(t time.Time) time.Time {
+	t = t.In(m.Location)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, m.Location)
+	// long holidays last about ten days, a month ahead is plenty
+	for i := 0; i < 31; i++ {
+		if m.IsTradingDay(day) {
+			for _, s := range m.Sessions {
+				if open := day.Add(time.Duration(s.Open) * time.Minute); open.After(t) {
+					return open
+				}
+			}
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+	return t.Add(time.Hour * 24)
+}
+
+// LastClose returns the last session close at or before t.
+func (m *Market) LastClose(t time.Time) time.Time {
+	t = t.In(m.Location)
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, m.Location)
+	for i := 0; i < 31; i++ {
+		if m.IsTradingDay(day) {
+			for j := len(m.Sessions) - 1; j >= 0; j-- {
+				if close := day.Add(time.Duration(m.Sessions[j].Close) * time.Minute); !close.After(t) {
+					return close
+				}
+			}
+		}
+		day = day.AddDate(0, 0, -1)
+	}
+	return t.Add(-time.Hour * 24)
+}
+
+// A Calendar knows the trading hours of markets and when cached quotes of
+// each market expire. It is safe for concurrent access.
+type Calendar struct {
+	mu         sync.RWMutex
+	markets    map[string]*Market
+	sessionTTL time.Duration
+}
+
+// NewCalendar create a new instance of Calendar for the SSE/SZSE, HKEX and
+// US markets with the embedded holidays. Quotes fetched while a market is
+// open expire after sessionTTL.
+func NewCalendar(sessionTTL time.Duration) *Calendar {
+	c := &Calendar{
+		markets: map[string]*Market{
+			MarketCN: {
+				Name:     MarketCN,
+				Location: chinaZone,
+				Sessions: []Session{{9*60 + 30, 11*60 + 30}, {13 * 60, 15 * 60}},
+			},
+			MarketHK: {
+				Name:     MarketHK,
+				Location: loadZone("Asia/Hong_Kong", 8*60*60),
+				Sessions: []Session{{9*60 + 30, 12 * 60}, {13 * 60, 16 * 60}},
+			},
+			MarketUS: {
+				Name:     MarketUS,
+				Location: loadZone("America/New_York", -5*60*60),
+				Sessions: []Session{{9*60 + 30, 16 * 60}},
+			},
+		},
+		sessionTTL: sessionTTL,
+	}
+	if err := c.setHolidays(defaultHolidays); err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// LoadHolidays replaces the holidays with the ones in the json file at path,
+// which maps market names to lists of "2006-01-02" dates.
+func (c *Calendar) LoadHolidays(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return c.setHolidays(b)
+}
+
+func (c *Calendar) setHolidays(b []byte) error {
+	dates := make(map[string][]string)
+	if err := json.Unmarshal(b, &dates); err != nil {
+		return fmt.Errorf("parse holidays failed: %s", err.Error())
+	}
+	holidays := make(map[string]map[string]bool)
+	for name, list := range dates {
+		holidays[name] = make(map[string]bool)
+		for _, date := range list {
+			if _, err := time.Parse("2006-01-02", date); err != nil {
+				return fmt.Errorf("parse holidays failed: %s", err.Error())
+			}
+			holidays[name][date] = true
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, m := range c.markets {
+		m.holidays = holidays[name]
+	}
+	return nil
+}
+
+// Market returns the named market, or nil if there's no such market.
+func (c *Calendar) Market(name string) *Market {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.markets[name]
+}
+
+// AnyOpen reports whether any market is trading at t.
+func (c *Calendar) AnyOpen(t time.Time) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, m := range c.markets {
+		if m.IsOpen(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Expiry returns when a quote of the market fetched at fetchedAt expires:
+// sessionTTL later if it was fetched while trading or shortly after a
+// close, otherwise at the next open since quotes can't change until then.
+func (c *Calendar) Expiry(market string, fetchedAt time.Time) time.Time {
+	m := c.Market(market)
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if m == nil || m.IsOpen(fetchedAt) || fetchedAt.Sub(m.LastClose(fetchedAt)) < closeGrace {
+		return fetchedAt.Add(c.sessionTTL)
+	}
+	return m.NextOpen(fetchedAt)
+}
+
+// marketOf returns the market of the first symbol of a key like those
+// Provider.Symbols accepts, or "" if it is unknown.
+func marketOf(key string) string {
+	if i := strings.LastIndex(key, "="); i >= 0 {
+		key = key[i+1:]
+	}
+	symbol := strings.ToLower(strings.TrimSpace(strings.Split(key, ",")[0]))
+	switch {
+	case strings.HasPrefix(symbol, "sh"), strings.HasPrefix(symbol, "sz"), strings.HasPrefix(symbol, "bj"):
+		return MarketCN
+	case strings.HasPrefix(symbol, "hk"), strings.HasPrefix(symbol, "rt_hk"):
+		return MarketHK
+	case strings.HasPrefix(symbol, "us"), strings.HasPrefix(symbol, "gb_"):
+		return MarketUS
+	}
+	return ""
+}
@@ -0,0 +1,105 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func cnTime(month time.Month, day, hour, minute int) time.Time {
+	return time.Date(2026, month, day, hour, minute, 0, 0, chinaZone)
+}
+
+func TestMarketIsOpen(t *testing.T) {
+	cn := NewCalendar(time.Minute).Market(MarketCN)
+	cases := []struct {
+		t    time.Time
+		open bool
+	}{
+		{cnTime(10, 19, 9, 29), false},
+		{cnTime(10, 19, 9, 30), true},
+		{cnTime(10, 19, 11, 45), false}, // lunch break
+		{cnTime(10, 19, 14, 59), true},
+		{cnTime(10, 19, 15, 0), false},
+		{cnTime(10, 17, 10, 0), false}, // saturday
+		{cnTime(2, 17, 10, 0), false},  // spring festival
+		{cnTime(10, 1, 10, 0), false},  // national day
+	}
+	for _, c := range cases {
+		if open := cn.IsOpen(c.t); open != c.open {
+			t.Fatalf("expect open %v at %s", c.open, c.t)
+		}
+	}
+
+	us := NewCalendar(time.Minute).Market(MarketUS)
+	if !us.IsOpen(cnTime(10, 19, 22, 0)) || us.IsOpen(cnTime(10, 19, 10, 0)) {
+		t.Fatal("expect us market to follow new york trading hours")
+	}
+}
+
+func TestMarketNextOpen(t *testing.T) {
+	cn := NewCalendar(time.Minute).Market(MarketCN)
+	cases := map[time.Time]time.Time{
+		cnTime(10, 19, 3, 0):   cnTime(10, 19, 9, 30),
+		cnTime(10, 19, 12, 0):  cnTime(10, 19, 13, 0),
+		cnTime(10, 16, 16, 0):  cnTime(10, 19, 9, 30), // friday to monday
+		cnTime(2, 13, 16, 0):   cnTime(2, 24, 9, 30),  // spring festival
+		cnTime(9, 30, 15, 30):  cnTime(10, 8, 9, 30),  // national day
+		cnTime(10, 19, 9, 30):  cnTime(10, 19, 13, 0),
+		cnTime(10, 19, 14, 30): cnTime(10, 20, 9, 30),
+	}
+	for from, expect := range cases {
+		if next := cn.NextOpen(from); !next.Equal(expect) {
+			t.Fatalf("expect next open after %s at %s, but %s got", from, expect, next)
+		}
+	}
+	if last := cn.LastClose(cnTime(10, 19, 9, 0)); !last.Equal(cnTime(10, 16, 15, 0)) {
+		t.Fatalf("expect last close on friday, but %s got", last)
+	}
+}
+
+func TestCalendarExpiry(t *testing.T) {
+	c := NewCalendar(time.Minute)
+	cases := map[time.Time]time.Time{
+		cnTime(10, 19, 10, 0):  cnTime(10, 19, 10, 1),
+		cnTime(10, 19, 15, 2):  cnTime(10, 19, 15, 3), // closing auction may still settle
+		cnTime(10, 19, 15, 30): cnTime(10, 20, 9, 30),
+		cnTime(10, 17, 3, 0):   cnTime(10, 19, 9, 30),
+	}
+	for fetchedAt, expect := range cases {
+		if expiry := c.Expiry(MarketCN, fetchedAt); !expiry.Equal(expect) {
+			t.Fatalf("expect quote fetched at %s to expire at %s, but %s got", fetchedAt, expect, expiry)
+		}
+	}
+
+	g := NewGroup("calendar", 2<<10, GetterFunc(func(key string) ([]byte, error) { return nil, nil }),
+		GroupWithCalendar(c))
+	key := "http://hq.sinajs.cn/list=sz000001"
+	if g.expired(key, time.Now()) || !g.expired(key, time.Now().AddDate(0, -1, 0)) {
+		t.Fatal("expect quotes to expire according to the calendar")
+	}
+	if !g.expired("unknown", time.Now().Add(-time.Minute*ExpireMinutes)) {
+		t.Fatal("expect unknown markets to expire after ExpireMinutes")
+	}
+}
+
+func TestLoadHolidays(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "holidays.json")
+	if err := os.WriteFile(path, []byte(`{"cn": ["2026-10-19"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c := NewCalendar(time.Minute)
+	if err := c.LoadHolidays(path); err != nil {
+		t.Fatalf("load holidays failed, error: %s", err.Error())
+	}
+	if cn := c.Market(MarketCN); cn.IsTradingDay(cnTime(10, 19, 10, 0)) || !cn.IsTradingDay(cnTime(2, 17, 10, 0)) {
+		t.Fatal("expect loaded holidays to replace the built-in ones")
+	}
+	if err := os.WriteFile(path, []byte(`{"cn": ["19/10/2026"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.LoadHolidays(path); err == nil {
+		t.Fatal("expect malformed dates to be rejected")
+	}
+}
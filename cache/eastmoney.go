@@ -0,0 +1,164 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"stock_data_cache/utils"
+	"strings"
+	"time"
+)
+
+const eastmoneyQuoteApi = "http://push2.eastmoney.com/api/qt/ulist.np/get?fltt=2&invt=2&fields=f2,f5,f6,f12,f13,f14,f15,f16,f17,f18,f124&secids="
+
+// EastmoneyProvider fetches quotes from push2.eastmoney.com.
+type EastmoneyProvider struct {
+	httpProvider
+}
+
+type eastmoneyResponse struct {
+	Rc   int            `json:"rc"`
+	Data *eastmoneyData `json:"data"`
+}
+
+type eastmoneyData struct {
+	Total int                      `json:"total"`
+	Diff  []map[string]interface{} `json:"diff"`
+}
+
+// NewEastmoneyProvider create a new instance of EastmoneyProvider
+func NewEastmoneyProvider() *EastmoneyProvider {
+	return &EastmoneyProvider{httpProvider{
+		api: eastmoneyQuoteApi,
+		headers: map[string]string{
+			"Accept":  "application/json",
+			"Referer": "https://quote.eastmoney.com/",
+		},
+		charset: "utf-8",
+	}}
+}
+
+// Name implements Provider
+func (p *EastmoneyProvider) Name() string {
+	return Eastmoney
+}
+
+// Symbols implements Provider, symbols may also be given as eastmoney secids
+// like "1.600000,0.000001".
+func (p *EastmoneyProvider) Symbols(key string) ([]string, error) {
+	if i := strings.LastIndex(key, "="); i >= 0 {
+		key = key[i+1:]
+	}
+	parts := strings.Split(key, ",")
+	for i, part := range parts {
+		if j := strings.Index(part, "."); j >= 0 {
+			parts[i] = eastmoneySymbol(part[:j], part[j+1:])
+		}
+	}
+	return splitSymbols(strings.Join(parts, ","))
+}
+
+// Fetch implements Provider
+func (p *EastmoneyProvider) Fetch(ctx context.Context, symbols []string, timeout time.Duration) ([]byte, error) {
+	defer utils.TimeTrack(time.Now(), "EastmoneyProvider.Fetch")
+
+	secids := make([]string, 0, len(symbols))
+	for _, symbol := range symbols {
+		secids = append(secids, eastmoneySecid(symbol))
+	}
+	return p.get(ctx, strings.Join(secids, ","), timeout)
+}
+
+// Validate implements Provider, unknown symbols are left out of the diff
+// list, which is null if none of the symbols is known.
+func (p *EastmoneyProvider) Validate(b []byte) error {
+	if err := validatePayload(Eastmoney, b); err != nil {
+		return err
+	}
+	var resp eastmoneyResponse
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return &PayloadError{Provider: Eastmoney, Kind: ErrMalformed, Detail: err.Error()}
+	}
+	if resp.Data == nil || len(resp.Data.Diff) == 0 {
+		return &PayloadError{Provider: Eastmoney, Kind: ErrEmpty, Detail: "no data"}
+	}
+	return nil
+}
+
+// Parse implements Provider, payloads look like
+// {"rc":0,"data":{"total":1,"diff":[{"f2":10.5,"f12":"600000","f13":1,...}]}}
+// where f5 volume is in lots of 100 shares and f124 is a unix timestamp.
+func (p *EastmoneyProvider) Parse(b []byte) ([]Quote, error) {
+	var resp eastmoneyResponse
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Rc != 0 {
+		return nil, fmt.Errorf("eastmoney rc: %d", resp.Rc)
+	}
+	quotes := make([]Quote, 0)
+	if resp.Data == nil {
+		return quotes, nil
+	}
+	for _, diff := range resp.Data.Diff {
+		code, _ := diff["f12"].(string)
+		market, _ := diff["f13"].(float64)
+		q := Quote{Symbol: eastmoneySymbol(fmt.Sprint(market), code)}
+		if _, _, err := splitSymbol(q.Symbol); err != nil {
+			return nil, err
+		}
+		q.Name, _ = diff["f14"].(string)
+		// suspended securities report "-" instead of numbers
+		q.Price, _ = diff["f2"].(float64)
+		q.Volume, _ = diff["f5"].(float64)
+		q.Amount, _ = diff["f6"].(float64)
+		q.High, _ = diff["f15"].(float64)
+		q.Low, _ = diff["f16"].(float64)
+		q.Open, _ = diff["f17"].(float64)
+		q.PrevClose, _ = diff["f18"].(float64)
+		q.Volume *= 100
+		ts, _ := diff["f124"].(float64)
+		q.Time = time.Unix(int64(ts), 0).In(chinaZone)
+		quotes = append(quotes, q)
+	}
+	return quotes, nil
+}
+
+// Format implements Provider
+func (p *EastmoneyProvider) Format(quotes []Quote) []byte {
+	var resp eastmoneyResponse
+	resp.Data = &eastmoneyData{Total: len(quotes), Diff: make([]map[string]interface{}, 0, len(quotes))}
+	for _, q := range quotes {
+		market := 0
+		if strings.HasPrefix(q.Symbol, "sh") {
+			market = 1
+		}
+		resp.Data.Diff = append(resp.Data.Diff, map[string]interface{}{
+			"f2": q.Price, "f5": q.Volume / 100, "f6": q.Amount, "f12": q.Symbol[2:], "f13": market,
+			"f14": q.Name, "f15": q.High, "f16": q.Low, "f17": q.Open, "f18": q.PrevClose, "f124": q.Time.Unix(),
+		})
+	}
+	b, _ := json.Marshal(resp)
+	return b
+}
+
+// eastmoneySecid maps a canonical symbol to an eastmoney secid, shanghai is
+// market 1 while shenzhen and beijing share market 0.
+func eastmoneySecid(symbol string) string {
+	if strings.HasPrefix(symbol, "sh") {
+		return "1." + symbol[2:]
+	}
+	return "0." + symbol[2:]
+}
+
+// eastmoneySymbol maps an eastmoney market and code to a canonical symbol.
+func eastmoneySymbol(market, code string) string {
+	switch {
+	case market == "1":
+		return "sh" + code
+	case strings.HasPrefix(code, "4") || strings.HasPrefix(code, "8"):
+		return "bj" + code
+	default:
+		return "sz" + code
+	}
+}
@@ -0,0 +1,424 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"stock_data_cache/utils"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	StateFollower  = "follower"
+	StateCandidate = "candidate"
+	StateLeader    = "leader"
+)
+
+const electionBasePath = "/election/"
+
+// ElectionConfig configures a node of a leader election. Nodes are named by
+// their base URLs, e.g. "http://10.0.0.1:7296".
+type ElectionConfig struct {
+	// ID is this node, Peers the other nodes
+	ID    string
+	Peers []string
+	// HeartbeatInterval is how often the leader tells the others it is alive
+	HeartbeatInterval time.Duration
+	// ElectionTimeout is how long a follower waits for the leader before it
+	// runs for leader, randomized up to twice as long
+	ElectionTimeout time.Duration
+}
+
+var DefaultElectionConfig = ElectionConfig{
+	HeartbeatInterval: time.Millisecond * 500,
+	ElectionTimeout:   time.Second * 2,
+}
+
+// VoteRequest asks a node to vote for Candidate in Term.
+type VoteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+}
+
+// VoteResponse is a node's vote, Term is its current term.
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// HeartbeatRequest tells a node Leader leads in Term.
+type HeartbeatRequest struct {
+	Term   uint64 `json:"term"`
+	Leader string `json:"leader"`
+}
+
+// HeartbeatResponse is a node's answer to a heartbeat, Term is its current
+// term.
+type HeartbeatResponse struct {
+	Term    uint64 `json:"term"`
+	Success bool   `json:"success"`
+}
+
+// A Transport carries the messages of an election to peers.
+type Transport interface {
+	RequestVote(peer string, req VoteRequest) (VoteResponse, error)
+	Heartbeat(peer string, req HeartbeatRequest) (HeartbeatResponse, error)
+}
+
+// Election elects a leader among nodes the way Raft does, without a log:
+// a follower that hears no heartbeat for its election timeout runs for
+// leader in a new term, and wins with the votes of a majority, each node
+// voting once per term. A leader that hears from no majority for an election
+// timeout steps down, so that a partitioned leader stops leading before the
+// others elect a new one. It is safe for concurrent access.
+type Election struct {
+	config    ElectionConfig
+	transport Transport
+
+	mu       sync.Mutex
+	term     uint64
+	votedFor string
+	state    string
+	leader   string
+	deadline time.Time // when a follower or candidate runs for leader
+	quorum   time.Time // when the last heartbeats a majority answered were sent
+	onLeader func(leader string)
+}
+
+// NewElection create a new instance of Election, it takes part once Run.
+func NewElection(config ElectionConfig, transport Transport) *Election {
+	e := &Election{config: config, transport: transport, state: StateFollower}
+	e.resetDeadline()
+	return e
+}
+
+// IsLeader reports whether this node leads.
+func (e *Election) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.checkQuorum()
+	return e.state == StateLeader
+}
+
+// Leader returns the node leading, or "" if it is unknown.
+func (e *Election) Leader() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.checkQuorum()
+	return e.leader
+}
+
+// Status returns this node's term and state.
+func (e *Election) Status() (term uint64, state string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.checkQuorum()
+	return e.term, e.state
+}
+
+// OnLeader calls f with the leader whenever this node learns of a new one,
+// itself included, from the goroutine running the election. It must be
+// called before Run.
+func (e *Election) OnLeader(f func(leader string)) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.onLeader = f
+}
+
+// Run takes part in the election until ctx is done.
+func (e *Election) Run(ctx context.Context) {
+	var known string
+	for ctx.Err() == nil {
+		e.mu.Lock()
+		leader, onLeader := e.leader, e.onLeader
+		e.mu.Unlock()
+		if leader != "" && leader != known && onLeader != nil {
+			onLeader(leader)
+		}
+		if leader != "" {
+			known = leader
+		}
+
+		if e.IsLeader() {
+			e.sendHeartbeats()
+			sleep(ctx, e.config.HeartbeatInterval)
+			continue
+		}
+		e.mu.Lock()
+		wait := time.Until(e.deadline)
+		e.mu.Unlock()
+		if wait > 0 {
+			// the deadline moves with heartbeats, look again at least this often
+			if wait > e.config.HeartbeatInterval {
+				wait = e.config.HeartbeatInterval
+			}
+			sleep(ctx, wait)
+			continue
+		}
+		e.campaign()
+	}
+}
+
+// HandleVote answers a candidate's vote request.
+func (e *Election) HandleVote(req VoteRequest) VoteResponse {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if req.Term < e.term {
+		return VoteResponse{Term: e.term}
+	}
+	if req.Term > e.term {
+		e.stepDown(req.Term)
+	}
+	if e.votedFor != "" && e.votedFor != req.Candidate {
+		return VoteResponse{Term: e.term}
+	}
+	e.votedFor = req.Candidate
+	e.resetDeadline()
+	return VoteResponse{Term: e.term, Granted: true}
+}
+
+// HandleHeartbeat answers a leader's heartbeat.
+func (e *Election) HandleHeartbeat(req HeartbeatRequest) HeartbeatResponse {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if req.Term < e.term {
+		return HeartbeatResponse{Term: e.term}
+	}
+	if req.Term > e.term || e.state != StateFollower {
+		e.stepDown(req.Term)
+	}
+	if e.leader != req.Leader {
+		fmt.Printf("leader elected, term: %d, leader: %s\n", req.Term, req.Leader)
+	}
+	e.leader = req.Leader
+	e.resetDeadline()
+	return HeartbeatResponse{Term: e.term, Success: true}
+}
+
+// campaign runs for leader in a new term.
+func (e *Election) campaign() {
+	e.mu.Lock()
+	e.term++
+	term := e.term
+	e.state = StateCandidate
+	e.votedFor = e.config.ID
+	e.leader = ""
+	e.resetDeadline()
+	e.mu.Unlock()
+	metrics.Set("election_term", float64(term))
+	// voters wait an election timeout from when they granted their votes
+	sent := time.Now()
+
+	votes := 1
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, peer := range e.config.Peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			resp, err := e.transport.RequestVote(peer, VoteRequest{Term: term, Candidate: e.config.ID})
+			if err != nil {
+				return
+			}
+			if resp.Granted {
+				mu.Lock()
+				votes++
+				mu.Unlock()
+			}
+			e.observe(resp.Term)
+		}(peer)
+	}
+	wg.Wait()
+
+	e.mu.Lock()
+	won := e.state == StateCandidate && e.term == term && votes > (len(e.config.Peers)+1)/2
+	if won {
+		e.state = StateLeader
+		e.leader = e.config.ID
+		e.quorum = sent
+		fmt.Printf("elected leader, term: %d, votes: %d\n", term, votes)
+	}
+	e.mu.Unlock()
+	if won {
+		metrics.Set("election_leader", 1)
+		e.sendHeartbeats()
+	}
+}
+
+// sendHeartbeats tells every peer this node leads, and notes the time they
+// were sent if a majority took them: no peer that did runs for leader before
+// an election timeout from then.
+func (e *Election) sendHeartbeats() {
+	e.mu.Lock()
+	req := HeartbeatRequest{Term: e.term, Leader: e.config.ID}
+	e.mu.Unlock()
+	sent := time.Now()
+	acks := 1
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, peer := range e.config.Peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			resp, err := e.transport.Heartbeat(peer, req)
+			if err != nil {
+				return
+			}
+			if resp.Success {
+				mu.Lock()
+				acks++
+				mu.Unlock()
+			}
+			e.observe(resp.Term)
+		}(peer)
+	}
+	wg.Wait()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.state == StateLeader && e.term == req.Term && acks > (len(e.config.Peers)+1)/2 && sent.After(e.quorum) {
+		e.quorum = sent
+	}
+}
+
+// checkQuorum steps down, with e.mu held, once the heartbeats a majority
+// last took were sent an election timeout less a heartbeat interval ago: the
+// others may run for leader an election timeout after they got them, the
+// margin leaves room for their clocks to run faster.
+func (e *Election) checkQuorum() {
+	if e.state != StateLeader || time.Since(e.quorum) < e.config.ElectionTimeout-e.config.HeartbeatInterval {
+		return
+	}
+	fmt.Printf("lost quorum, term: %d\n", e.term)
+	e.stepDown(e.term)
+	e.leader = ""
+}
+
+// observe steps down if a peer is in a later term.
+func (e *Election) observe(term uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if term > e.term {
+		e.stepDown(term)
+	}
+}
+
+// stepDown makes the node a follower in term, with e.mu held.
+func (e *Election) stepDown(term uint64) {
+	if e.state == StateLeader {
+		fmt.Printf("lost leadership, term: %d\n", term)
+		metrics.Set("election_leader", 0)
+	}
+	if term > e.term {
+		e.term = term
+		e.votedFor = ""
+		e.leader = ""
+	}
+	e.state = StateFollower
+	e.resetDeadline()
+	metrics.Set("election_term", float64(e.term))
+}
+
+// resetDeadline sets a new randomized election timeout, with e.mu held.
+func (e *Election) resetDeadline() {
+	timeout := e.config.ElectionTimeout + time.Duration(rand.Int63n(int64(e.config.ElectionTimeout)+1))
+	e.deadline = time.Now().Add(timeout)
+}
+
+// HTTPTransport carries election messages between HTTPPools, the election
+// of each pool is served at /election/.
+type HTTPTransport struct {
+	timeout time.Duration
+}
+
+// NewHTTPTransport create a new instance of HTTPTransport, messages time out
+// after timeout.
+func NewHTTPTransport(timeout time.Duration) *HTTPTransport {
+	return &HTTPTransport{timeout: timeout}
+}
+
+// RequestVote implements Transport
+func (t *HTTPTransport) RequestVote(peer string, req VoteRequest) (resp VoteResponse, err error) {
+	err = t.post(peer, "vote", req, &resp)
+	return
+}
+
+// Heartbeat implements Transport
+func (t *HTTPTransport) Heartbeat(peer string, req HeartbeatRequest) (resp HeartbeatResponse, err error) {
+	err = t.post(peer, "heartbeat", req, &resp)
+	return
+}
+
+func (t *HTTPTransport) post(peer, message string, req, resp interface{}) error {
+	b, _ := json.Marshal(req)
+	u := strings.TrimRight(peer, "/") + electionBasePath + message
+	b, err := utils.DoPostRequest(u, t.timeout, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, resp)
+}
+
+// ErrUnreachable is a message to a node a MemoryTransport can't reach.
+var ErrUnreachable = errors.New("node unreachable")
+
+// MemoryTransport carries election messages between nodes in one process,
+// e.g. to try elections locally. It is safe for concurrent access.
+type MemoryTransport struct {
+	mu           sync.RWMutex
+	nodes        map[string]*Election
+	disconnected map[string]bool
+}
+
+// NewMemoryTransport create a new instance of MemoryTransport
+func NewMemoryTransport() *MemoryTransport {
+	return &MemoryTransport{nodes: make(map[string]*Election), disconnected: make(map[string]bool)}
+}
+
+// Add makes the node id reachable as e.
+func (t *MemoryTransport) Add(id string, e *Election) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.nodes[id] = e
+}
+
+// SetConnected cuts a node off from every other node, or reconnects it.
+func (t *MemoryTransport) SetConnected(id string, connected bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.disconnected[id] = !connected
+}
+
+// node returns the node peer if both it and from are connected.
+func (t *MemoryTransport) node(from, peer string) (*Election, error) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	e, ok := t.nodes[peer]
+	if !ok || t.disconnected[peer] || t.disconnected[from] {
+		return nil, ErrUnreachable
+	}
+	return e, nil
+}
+
+// RequestVote implements Transport
+func (t *MemoryTransport) RequestVote(peer string, req VoteRequest) (VoteResponse, error) {
+	e, err := t.node(req.Candidate, peer)
+	if err != nil {
+		return VoteResponse{}, err
+	}
+	return e.HandleVote(req), nil
+}
+
+// Heartbeat implements Transport
+func (t *MemoryTransport) Heartbeat(peer string, req HeartbeatRequest) (HeartbeatResponse, error) {
+	e, err := t.node(req.Leader, peer)
+	if err != nil {
+		return HeartbeatResponse{}, err
+	}
+	return e.HandleHeartbeat(req), nil
+}
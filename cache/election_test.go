@@ -0,0 +1,209 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testElectionConfig = ElectionConfig{
+	HeartbeatInterval: time.Millisecond * 10,
+	ElectionTimeout:   time.Millisecond * 50,
+}
+
+// waitLeader waits for exactly one of nodes to lead and returns it.
+func waitLeader(t *testing.T, nodes map[string]*Election) string {
+	for deadline := time.Now().Add(time.Second * 2); time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+		leaders := make([]string, 0)
+		for id, e := range nodes {
+			if e.IsLeader() {
+				leaders = append(leaders, id)
+			}
+		}
+		if len(leaders) == 1 {
+			return leaders[0]
+		}
+	}
+	t.Fatal("expect a single leader to be elected")
+	return ""
+}
+
+func TestElection(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	transport := NewMemoryTransport()
+	nodes := make(map[string]*Election)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, id := range ids {
+		config := testElectionConfig
+		config.ID = id
+		for _, peer := range ids {
+			if peer != id {
+				config.Peers = append(config.Peers, peer)
+			}
+		}
+		nodes[id] = NewElection(config, transport)
+		transport.Add(id, nodes[id])
+	}
+	for _, e := range nodes {
+		go e.Run(ctx)
+	}
+
+	leader := waitLeader(t, nodes)
+	term, _ := nodes[leader].Status()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond * 10) {
+		known := 0
+		for _, e := range nodes {
+			if e.Leader() == leader {
+				known++
+			}
+		}
+		if known == len(nodes) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expect every node to know leader %s", leader)
+		}
+	}
+
+	// the others elect a new leader without the old one
+	transport.SetConnected(leader, false)
+	others := make(map[string]*Election)
+	for id, e := range nodes {
+		if id != leader {
+			others[id] = e
+		}
+	}
+	next := waitLeader(t, others)
+	if nextTerm, _ := others[next].Status(); nextTerm <= term {
+		t.Fatalf("expect a new term after %d, but %d got", term, nextTerm)
+	}
+
+	// the old leader follows once it hears of the new term
+	transport.SetConnected(leader, true)
+	if waitLeader(t, nodes) == leader {
+		t.Fatalf("expect %s to step down", leader)
+	}
+}
+
+func TestElectionVote(t *testing.T) {
+	e := NewElection(ElectionConfig{ID: "a", HeartbeatInterval: time.Second, ElectionTimeout: time.Second}, NewMemoryTransport())
+	if resp := e.HandleVote(VoteRequest{Term: 1, Candidate: "b"}); !resp.Granted {
+		t.Fatal("expect a vote for the first candidate of a term")
+	}
+	if resp := e.HandleVote(VoteRequest{Term: 1, Candidate: "c"}); resp.Granted {
+		t.Fatal("expect a single vote per term")
+	}
+	if resp := e.HandleHeartbeat(HeartbeatRequest{Term: 0, Leader: "c"}); resp.Success || resp.Term != 1 {
+		t.Fatal("expect heartbeats of an earlier term to be rejected")
+	}
+	if resp := e.HandleVote(VoteRequest{Term: 2, Candidate: "c"}); !resp.Granted {
+		t.Fatal("expect a vote in a later term")
+	}
+}
+
+func TestFollowerRedirect(t *testing.T) {
+	NewGroup("elected", 2<<10, GetterFunc(func(key string) ([]byte, error) { return []byte(key), nil }))
+	e := NewElection(ElectionConfig{ID: "http://follower", HeartbeatInterval: time.Second, ElectionTimeout: time.Second}, NewMemoryTransport())
+	p := NewHTTPPool("http://follower", HTTPPoolWithElection(e))
+
+	if code := postUpdate(p, "elected", "a", []byte("1")); code != http.StatusServiceUnavailable {
+		t.Fatalf("expect writes to fail without a leader, but %d got", code)
+	}
+	e.HandleHeartbeat(HeartbeatRequest{Term: 1, Leader: "http://leader"})
+	r := httptest.NewRequest(http.MethodDelete, defaultBasePath+"elected?key=a", nil)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	if w.Code != http.StatusTemporaryRedirect || w.Header().Get("Location") != "http://leader"+defaultBasePath+"elected?key=a" {
+		t.Fatalf("expect a redirect to the leader, but %d %q got", w.Code, w.Header().Get("Location"))
+	}
+	r = httptest.NewRequest(http.MethodGet, defaultBasePath+"elected?key=a", nil)
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || w.Body.String() != "a" {
+		t.Fatalf("expect followers to serve reads, but %d got", w.Code)
+	}
+}
+
+func TestElectionCheckQuorum(t *testing.T) {
+	ids := []string{"a", "b", "c"}
+	transport := NewMemoryTransport()
+	nodes := make(map[string]*Election)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	for _, id := range ids {
+		config := testElectionConfig
+		config.ID = id
+		for _, peer := range ids {
+			if peer != id {
+				config.Peers = append(config.Peers, peer)
+			}
+		}
+		nodes[id] = NewElection(config, transport)
+		transport.Add(id, nodes[id])
+	}
+	for _, e := range nodes {
+		go e.Run(ctx)
+	}
+
+	// a leader cut off from the others steps down on its own
+	leader := waitLeader(t, nodes)
+	transport.SetConnected(leader, false)
+	// and it does so before the others elect a new one
+	waitFor(t, "a new leader", func() bool {
+		for id, e := range nodes {
+			if id != leader && e.IsLeader() {
+				return true
+			}
+		}
+		return false
+	})
+	if nodes[leader].IsLeader() {
+		t.Fatal("expect the partitioned leader to step down before a new one is elected")
+	}
+	waitFor(t, "the partitioned leader to step down", func() bool { return !nodes[leader].IsLeader() })
+	if nodes[leader].Leader() != "" {
+		t.Fatalf("expect no leader known after losing quorum, but %s got", nodes[leader].Leader())
+	}
+}
+
+func TestFollowLeader(t *testing.T) {
+	g := NewGroup("followed", 2<<10, GetterFunc(func(key string) ([]byte, error) { return nil, nil }),
+		GroupWithMode(ModeMaster))
+	leader := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == adminReplicationPath {
+			_ = json.NewEncoder(w).Encode(ReplicationResponse{Epoch: "e1", Ops: []ReplicationOp{}})
+			return
+		}
+		if r.URL.Path == defaultBasePath+"followed" && r.Header.Get(peerHeader) != "" {
+			_, _ = w.Write([]byte("leader " + r.URL.Query().Get("key")))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer leader.Close()
+
+	e := NewElection(ElectionConfig{ID: "http://self", HeartbeatInterval: time.Millisecond * 10, ElectionTimeout: time.Millisecond * 200},
+		NewMemoryTransport())
+	FollowLeader(e, time.Millisecond*10)
+	defer Promote()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e.HandleHeartbeat(HeartbeatRequest{Term: 1, Leader: leader.URL})
+	go e.Run(ctx)
+
+	waitFor(t, "the follower to replicate from the leader", func() bool { return Primary() == leader.URL })
+	e.HandleHeartbeat(HeartbeatRequest{Term: 1, Leader: leader.URL})
+	if v, err := g.Get("a"); err != nil || v.String() != "leader a" {
+		t.Fatalf("expect a follower's miss to be asked of the leader, but %q, %v got", v, err)
+	}
+	if g.queue.Len() != 0 {
+		t.Fatal("expect a follower not to queue misses nobody drains")
+	}
+
+	// without heartbeats the single node elects itself and takes over
+	waitFor(t, "the follower to be promoted", func() bool { return e.IsLeader() && Role() == RolePrimary })
+}
@@ -0,0 +1,186 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HealthyScore is the score below which a provider is only tried after
+// all healthy providers failed.
+const HealthyScore = 0.5
+
+// healthDecay weights the latest result in a provider's health score.
+const healthDecay = 0.2
+
+// HealthRecovery is the half-life of a provider's distance to a full score,
+// so an unhealthy provider is tried first again after a while without
+// results instead of being skipped for good.
+const HealthRecovery = time.Minute
+
+// providerHealth scores providers by an exponentially weighted success
+// rate, starting at 1 for providers without results and recovering towards
+// it over time.
+type providerHealth struct {
+	mu       sync.Mutex
+	recovery time.Duration
+	scores   map[string]float64
+	updated  map[string]time.Time
+}
+
+var health = newProviderHealth(HealthRecovery)
+
+// newProviderHealth create a new instance of providerHealth
+func newProviderHealth(recovery time.Duration) *providerHealth {
+	return &providerHealth{recovery: recovery, scores: make(map[string]float64), updated: make(map[string]time.Time)}
+}
+
+func (h *providerHealth) score(name string) float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.current(name)
+}
+
+// current returns the score of name recovered since its last result, h.mu
+// must be held.
+func (h *providerHealth) current(name string) float64 {
+	s, ok := h.scores[name]
+	if !ok {
+		return 1
+	}
+	elapsed := time.Since(h.updated[name])
+	return 1 - (1-s)*math.Pow(0.5, float64(elapsed)/float64(h.recovery))
+}
+
+func (h *providerHealth) record(name string, ok bool) {
+	h.mu.Lock()
+	s := h.current(name)
+	result := 0.0
+	if ok {
+		result = 1
+	}
+	s = (1-healthDecay)*s + healthDecay*result
+	h.scores[name] = s
+	h.updated[name] = time.Now()
+	h.mu.Unlock()
+
+	metrics.Set("upstream_health", s, "provider", name)
+}
+
+// GroupWithFailover makes the group fall back to providers, in order, when
+// its own provider fails.
+func GroupWithFailover(providers ...Provider) GroupOption {
+	return func(g *Group) {
+		g.fallbacks = append(g.fallbacks, providers...)
+	}
+}
+
+// candidates returns the group's providers in the order they should be tried:
+// the configured order, with unhealthy providers moved to the end.
+func (g *Group) candidates() []Provider {
+	healthy := make([]Provider, 0, len(g.fallbacks)+1)
+	unhealthy := make([]Provider, 0)
+	for _, p := range append([]Provider{g.provider}, g.fallbacks...) {
+		if health.score(p.Name()) < HealthyScore {
+			unhealthy = append(unhealthy, p)
+		} else {
+			healthy = append(healthy, p)
+		}
+	}
+	return append(healthy, unhealthy...)
+}
+
+// fetchFrom fetches key from provider p, failing unless every symbol of key
+// got a quote.
+func fetchFrom(ctx context.Context, p Provider, key string) ([]byte, []Quote, error) {
+	symbols, err := p.Symbols(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := p.Fetch(ctx, symbols, FetchTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	quotes, err := validate(p, symbols, b)
+	if err != nil {
+		return nil, nil, err
+	}
+	return b, quotes, nil
+}
+
+// validate parses payload b of provider p, failing with a PayloadError unless
+// it holds a quote for every one of symbols.
+func validate(p Provider, symbols []string, b []byte) ([]Quote, error) {
+	if err := p.Validate(b); err != nil {
+		return nil, err
+	}
+	quotes, err := p.Parse(b)
+	if err != nil {
+		return nil, &PayloadError{Provider: p.Name(), Kind: ErrMalformed, Detail: err.Error()}
+	}
+	got := make(map[string]bool, len(quotes))
+	for _, q := range quotes {
+		got[q.Symbol] = true
+	}
+	for _, symbol := range symbols {
+		if !got[symbol] {
+			return nil, &PayloadError{Provider: p.Name(), Kind: ErrEmpty, Detail: "no quote for " + symbol}
+		}
+	}
+	return quotes, nil
+}
+
+// fetchWithFailover tries the group's providers in turn. Values fetched from
+// a fallback provider are rendered in the format of the group's provider.
+// It gives up once ctx is done.
+func (g *Group) fetchWithFailover(ctx context.Context, key string) ([]byte, error) {
+	errs := &FailoverError{}
+	for _, p := range g.candidates() {
+		b, quotes, err := fetchFrom(ctx, p, key)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		health.record(p.Name(), err == nil)
+		g.countInvalid(p, err)
+		if err != nil {
+			metrics.Inc("upstream_requests_total", "provider", p.Name(), "result", "failure")
+			fmt.Printf("fetch failed, provider: %s, key: %s, error: %s\n", p.Name(), key, err.Error())
+			errs.Providers = append(errs.Providers, p.Name())
+			errs.Errs = append(errs.Errs, err)
+			continue
+		}
+		metrics.Inc("upstream_requests_total", "provider", p.Name(), "result", "success")
+		if p != g.provider {
+			fmt.Printf("failover, group: %s, key: %s, from: %s, to: %s\n", g.name, key, g.provider.Name(), p.Name())
+			metrics.Inc("upstream_failover_total", "group", g.name, "from", g.provider.Name(), "to", p.Name())
+			b = g.provider.Format(quotes)
+		}
+		return b, nil
+	}
+	return nil, errs
+}
+
+// FailoverError reports the error of each provider tried for a key, in
+// order. It unwraps to the last one.
+type FailoverError struct {
+	Providers []string
+	Errs      []error
+}
+
+func (e *FailoverError) Error() string {
+	errs := make([]string, 0, len(e.Errs))
+	for i, err := range e.Errs {
+		errs = append(errs, e.Providers[i]+": "+err.Error())
+	}
+	return strings.Join(errs, "; ")
+}
+
+func (e *FailoverError) Unwrap() error {
+	if len(e.Errs) == 0 {
+		return nil
+	}
+	return e.Errs[len(e.Errs)-1]
+}
@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"stock_data_cache/utils"
+	"strings"
+	"testing"
+)
+
+// newStandIn starts a local stand-in for an upstream serving body.
+func newStandIn(t *testing.T, status int, body string) (*httptest.Server, *int) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(status)
+		_, _ = fmt.Fprint(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &requests
+}
+
+func TestFailover(t *testing.T) {
+	health = newProviderHealth(HealthRecovery)
+	ConfigureUpstreams(UpstreamConfig{Retry: utils.RetryPolicy{Attempts: 1}, BreakerThreshold: 100})
+	defer ConfigureUpstreams(DefaultUpstreamConfig)
+
+	sinaSrv, sinaRequests := newStandIn(t, http.StatusOK, `var hq_str_sz000001="";`)
+	tencentSrv, _ := newStandIn(t, http.StatusInternalServerError, "")
+	eastmoneySrv, _ := newStandIn(t, http.StatusOK, `{"rc":0,"data":{"total":1,"diff":[{"f2":17.8,"f5":1234567,`+
+		`"f6":2198765432,"f12":"000001","f13":0,"f14":"平安银行","f15":17.9,"f16":17.3,"f17":17.5,"f18":17.4,"f124":1629442803}]}}`)
+
+	sina, tencent, eastmoney := NewSinaProvider(), NewTencentProvider(), NewEastmoneyProvider()
+	sina.api = sinaSrv.URL + "/list="
+	tencent.api = tencentSrv.URL + "/q="
+	eastmoney.api = eastmoneySrv.URL + "/get?secids="
+	g := NewGroup("failover", 2<<10, nil, GroupWithProvider(sina), GroupWithFailover(tencent, eastmoney))
+
+	before := metrics.Get("upstream_failover_total", "group", "failover", "from", Sina, "to", Eastmoney)
+	b, err := g.fetch(context.Background(), "http://hq.sinajs.cn/list=sz000001")
+	if err != nil {
+		t.Fatalf("fetch failed, error: %s", err.Error())
+	}
+	if !strings.HasPrefix(string(b), `var hq_str_sz000001="平安银行,17.500,17.400,17.800,`) {
+		t.Fatalf("expect value in sina format, but %s got", b)
+	}
+	if after := metrics.Get("upstream_failover_total", "group", "failover", "from", Sina, "to", Eastmoney); after != before+1 {
+		t.Fatalf("expect failover to be counted, but %g got", after-before)
+	}
+
+	// sina and tencent drop below HealthyScore and are tried last
+	for i := 0; i < 3; i++ {
+		_, _ = g.fetch(context.Background(), "sz000001")
+	}
+	if s := health.score(Sina); s >= HealthyScore {
+		t.Fatalf("expect sina to be unhealthy, but score %g got", s)
+	}
+	if c := g.candidates(); c[0] != eastmoney {
+		t.Fatalf("expect eastmoney to be tried first, but %s got", c[0].Name())
+	}
+	requests := *sinaRequests
+	if _, err := g.fetch(context.Background(), "sz000001"); err != nil || *sinaRequests != requests {
+		t.Fatalf("expect unhealthy sina to be skipped, error: %v", err)
+	}
+
+	// once sina recovers, it is tried first again after a while without results
+	recovered, recoveredRequests := newStandIn(t, http.StatusOK, string(b))
+	sina.api = recovered.URL + "/list="
+	health.mu.Lock()
+	for name := range health.updated {
+		health.updated[name] = health.updated[name].Add(-HealthRecovery * 2)
+	}
+	health.mu.Unlock()
+	if c := g.candidates(); c[0] != sina {
+		t.Fatalf("expect sina to be tried first again, but %s got", c[0].Name())
+	}
+	before = metrics.Get("upstream_failover_total", "group", "failover", "from", Sina, "to", Eastmoney)
+	if _, err := g.fetch(context.Background(), "sz000001"); err != nil || *recoveredRequests != 1 {
+		t.Fatalf("expect recovered sina to be fetched from, error: %v", err)
+	}
+	if after := metrics.Get("upstream_failover_total", "group", "failover", "from", Sina, "to", Eastmoney); after != before {
+		t.Fatalf("expect no failover from recovered sina, but %g got", after-before)
+	}
+
+	eastmoney.api = tencentSrv.URL + "/get?secids="
+	sina.api = sinaSrv.URL + "/list="
+	if _, err := g.fetch(context.Background(), "sz000001"); err == nil {
+		t.Fatal("expect error when every provider fails")
+	}
+}
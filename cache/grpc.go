@@ -0,0 +1,388 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"stock_data_cache/pb"
+	"stock_data_cache/utils"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultStreamPollInterval is how often a WorkServer looks for keys to lease
+// to a slave with credit left, and for leases to cancel.
+const DefaultStreamPollInterval = time.Millisecond * 200
+
+// WorkServer implements the Work service of package pb: it leases the missed
+// keys of a group to the slaves streaming from it, at most their credit at
+// once, and caches the values they stream back like updates over HTTP.
+type WorkServer struct {
+	pb.UnimplementedWorkServer
+	election *Election
+	poll     time.Duration
+}
+
+// A WorkServerOption configures a WorkServer.
+type WorkServerOption func(*WorkServer)
+
+// WorkServerWithElection refuses slaves while this node follows, only the
+// leader's queue is drained.
+func WorkServerWithElection(e *Election) WorkServerOption {
+	return func(s *WorkServer) {
+		s.election = e
+	}
+}
+
+// WorkServerWithPollInterval sets how often the server looks for keys to
+// lease and leases to cancel.
+func WorkServerWithPollInterval(poll time.Duration) WorkServerOption {
+	return func(s *WorkServer) {
+		s.poll = poll
+	}
+}
+
+// NewWorkServer create a new instance of WorkServer
+func NewWorkServer(opts ...WorkServerOption) *WorkServer {
+	s := &WorkServer{poll: DefaultStreamPollInterval}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+var _ pb.WorkServer = (*WorkServer)(nil)
+
+// Refresh implements pb.WorkServer
+func (s *WorkServer) Refresh(stream pb.Work_RefreshServer) error {
+	if Role() == RoleReplica {
+		return status.Error(codes.FailedPrecondition, "read-only replica of "+Primary())
+	}
+	if s.election != nil && !s.election.IsLeader() {
+		return status.Error(codes.FailedPrecondition, "not the leader, leader: "+s.election.Leader())
+	}
+	msg, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	hello := msg.GetHello()
+	if hello == nil || hello.Slave == "" {
+		return status.Error(codes.InvalidArgument, "expect a hello first")
+	}
+	g := GetGroup(hello.Group)
+	if g == nil {
+		return status.Error(codes.NotFound, "no such group: "+hello.Group)
+	}
+	id := hello.Slave
+	slaves.Register(id, hello.Capabilities)
+	fmt.Printf("slave streaming, id: %s, group: %s, credit: %d\n", id, g.name, hello.Credit)
+	ctx := stream.Context()
+	messages := make(chan *pb.SlaveMessage)
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+			select {
+			case messages <- msg:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	credit := int(hello.Credit)
+	leased := make(map[string]string) // keys by lease token
+	defer func() {
+		// keys the slave didn't refresh go back to the queue at once, only
+		// the ones leased on this stream: the slave may have reconnected
+		n := 0
+		for token := range leased {
+			if g.queue.ReleaseLease(token) {
+				n++
+			}
+		}
+		fmt.Printf("slave stream closed, id: %s, released: %d\n", id, n)
+	}()
+	ticker := time.NewTicker(s.poll)
+	defer ticker.Stop()
+	for {
+		for credit > 0 {
+			lease, ok := g.LeaseMissed(id)
+			if !ok {
+				break
+			}
+			assignment := &pb.Assignment{Key: lease.Key, Lease: lease.Token, Attempts: int32(lease.Attempts)}
+			if err := stream.Send(&pb.MasterMessage{Body: &pb.MasterMessage_Assignment{Assignment: assignment}}); err != nil {
+				return err
+			}
+			leased[lease.Token] = lease.Key
+			credit--
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case err := <-errs:
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		case msg := <-messages:
+			switch body := msg.Body.(type) {
+			case *pb.SlaveMessage_Result:
+				s.result(g, id, body.Result)
+				// results of cancelled leases returned their credit already
+				if _, ok := leased[body.Result.Lease]; ok {
+					delete(leased, body.Result.Lease)
+					credit++
+				}
+			case *pb.SlaveMessage_Credit:
+				credit += int(body.Credit.Credit)
+			}
+		case <-ticker.C:
+			// the open stream keeps the slave alive
+			if !slaves.Heartbeat(id) {
+				slaves.Register(id, hello.Capabilities)
+			}
+			for token, key := range leased {
+				if g.queue.Leased(token) {
+					continue
+				}
+				fmt.Printf("lease cancelled, slave: %s, key: %s\n", id, key)
+				delete(leased, token)
+				credit++
+				if err := stream.Send(&pb.MasterMessage{Body: &pb.MasterMessage_Cancel{Cancel: &pb.Cancel{Lease: token}}}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// result caches the value a slave streamed back for a key, or records its
+// failure to fetch it.
+func (s *WorkServer) result(g *Group, slave string, r *pb.Result) {
+	if r.Error != "" {
+		g.nack(NackRequest{Key: r.Key, Lease: r.Lease, Slave: slave, Class: r.ErrorClass, Message: r.Error})
+		return
+	}
+	// update logs and counts its own failures
+	_, _ = g.update(UpdateCacheRequest{
+		Key:     r.Key,
+		Value:   string(r.Value),
+		Version: r.Version,
+		Lease:   r.Lease,
+		Slave:   slave,
+	})
+}
+
+// RunStream refreshes the keys the master streams to the slave over conn,
+// e.g. grpc.Dial("10.0.0.1:7297", ...), until ctx is done. It reconnects
+// whenever the stream breaks.
+func (s *Slave) RunStream(ctx context.Context, conn grpc.ClientConnInterface) {
+	client := pb.NewWorkClient(conn)
+	for ctx.Err() == nil {
+		if err := s.stream(ctx, client); err != nil && ctx.Err() == nil {
+			fmt.Printf("slave stream failed, id: %s, error: %s\n", s.id, err.Error())
+			sleep(ctx, time.Second)
+		}
+	}
+}
+
+// A streamJob is a key assigned to a slave over a stream, its context is
+// cancelled if the master cancels the lease.
+type streamJob struct {
+	assignment *pb.Assignment
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+// stream refreshes keys until the stream breaks: each of the slave's workers
+// fetches the keys assigned to it in batches, see GroupWithBatch.
+func (s *Slave) stream(ctx context.Context, client pb.WorkClient) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	stream, err := client.Refresh(ctx)
+	if err != nil {
+		return err
+	}
+	var sendMu sync.Mutex
+	send := func(msg *pb.SlaveMessage) error {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		return stream.Send(msg)
+	}
+	credit := s.workers
+	if s.group.batchSymbols > 1 {
+		credit *= s.group.batchSymbols
+	}
+	hello := &pb.Hello{Slave: s.id, Group: s.group.name, Capabilities: s.capabilities, Credit: int32(credit)}
+	if err := send(&pb.SlaveMessage{Body: &pb.SlaveMessage_Hello{Hello: hello}}); err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	jobs := make(map[string]*streamJob) // by lease token
+	// the master assigns at most the credit, plus cancelled keys that may
+	// still wait here
+	assigned := make(chan *streamJob, credit*2)
+	for i := 0; i < s.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				batch := s.gather(ctx, assigned)
+				if batch == nil {
+					return
+				}
+				batchCtx, cancelBatch := batchContext(ctx, batch)
+				results := s.refresh(batchCtx, batch)
+				cancelBatch()
+				for _, result := range results {
+					mu.Lock()
+					job := jobs[result.Lease]
+					delete(jobs, result.Lease)
+					mu.Unlock()
+					// the results of cancelled leases are dropped, the upstream
+					// request is aborted if every lease of the batch is cancelled
+					if job == nil || job.ctx.Err() != nil {
+						continue
+					}
+					job.cancel()
+					if err := send(&pb.SlaveMessage{Body: &pb.SlaveMessage_Result{Result: result}}); err != nil {
+						fmt.Printf("send result failed, key: %s, error: %s\n", result.Key, err.Error())
+					}
+				}
+			}
+		}()
+	}
+
+	for {
+		msg, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		switch body := msg.Body.(type) {
+		case *pb.MasterMessage_Assignment:
+			job := &streamJob{assignment: body.Assignment}
+			job.ctx, job.cancel = context.WithCancel(ctx)
+			mu.Lock()
+			jobs[body.Assignment.Lease] = job
+			mu.Unlock()
+			select {
+			case assigned <- job:
+			default:
+				// fail it at once, the master would hold the lease until it expired
+				fmt.Printf("assignment beyond credit refused, key: %s\n", body.Assignment.Key)
+				mu.Lock()
+				delete(jobs, body.Assignment.Lease)
+				mu.Unlock()
+				job.cancel()
+				result := &pb.Result{Key: body.Assignment.Key, Lease: body.Assignment.Lease, Error: "assignment beyond credit", ErrorClass: FailureOther}
+				if err := send(&pb.SlaveMessage{Body: &pb.SlaveMessage_Result{Result: result}}); err != nil {
+					return err
+				}
+			}
+		case *pb.MasterMessage_Cancel:
+			mu.Lock()
+			if job, ok := jobs[body.Cancel.Lease]; ok {
+				job.cancel()
+				delete(jobs, body.Cancel.Lease)
+			}
+			mu.Unlock()
+		}
+	}
+}
+
+// gather waits for an assigned key, then gathers more for the group's batch
+// window until it has a batch of symbols. It returns nil once ctx is done.
+func (s *Slave) gather(ctx context.Context, assigned <-chan *streamJob) []*streamJob {
+	var batch []*streamJob
+	var window <-chan time.Time
+	symbols := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-window:
+			return batch
+		case job := <-assigned:
+			if job.ctx.Err() != nil {
+				continue
+			}
+			batch = append(batch, job)
+			symbols += s.group.symbolCount(job.assignment.Key)
+			if symbols >= s.group.batchSymbols {
+				return batch
+			}
+			if window == nil {
+				window = time.After(s.group.batchWindow)
+			}
+		}
+	}
+}
+
+// batchContext returns a context done once ctx or the context of every job
+// of batch is, so that cancelling every lease of a batch aborts its upstream
+// request.
+func batchContext(ctx context.Context, batch []*streamJob) (context.Context, context.CancelFunc) {
+	if len(batch) == 1 {
+		return context.WithCancel(batch[0].ctx)
+	}
+	batchCtx, cancel := context.WithCancel(ctx)
+	go func() {
+		for _, job := range batch {
+			select {
+			case <-job.ctx.Done():
+			case <-batchCtx.Done():
+				return
+			}
+		}
+		cancel()
+	}()
+	return batchCtx, cancel
+}
+
+// refresh fetches a batch of assigned keys until ctx is done, waiting a while
+// first if every upstream is down.
+func (s *Slave) refresh(ctx context.Context, batch []*streamJob) []*pb.Result {
+	results := make([]*pb.Result, 0, len(batch))
+	keys := make([]string, 0, len(batch))
+	for _, job := range batch {
+		results = append(results, &pb.Result{Key: job.assignment.Key, Lease: job.assignment.Lease})
+		keys = append(keys, job.assignment.Key)
+	}
+	g := s.group
+	if !g.available() {
+		fmt.Printf("every upstream is down, group: %s\n", g.name)
+		sleep(ctx, time.Second*10)
+		for _, result := range results {
+			result.Error = utils.ErrBreakerOpen.Error()
+			result.ErrorClass = FailureBreakerOpen
+		}
+		return results
+	}
+	fetchedAt := time.Now()
+	values, errs := g.fetchBatch(ctx, keys)
+	for _, result := range results {
+		if err, ok := errs[result.Key]; ok {
+			result.Error = err.Error()
+			result.ErrorClass = classify(err)
+			continue
+		}
+		result.Value = values[result.Key]
+		result.Version = fetchedAt.UnixNano()
+	}
+	return results
+}
@@ -0,0 +1,165 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"stock_data_cache/pb"
+	"stock_data_cache/utils"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// dialWorkServer serves a WorkServer in memory and dials it.
+func dialWorkServer(t *testing.T) *grpc.ClientConn {
+	lis := bufconn.Listen(1 << 20)
+	server := grpc.NewServer()
+	pb.RegisterWorkServer(server, NewWorkServer(WorkServerWithPollInterval(time.Millisecond*10)))
+	go func() { _ = server.Serve(lis) }()
+	t.Cleanup(server.Stop)
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("dial failed, error: %s", err.Error())
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return conn
+}
+
+// waitFor polls cond for up to a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(time.Millisecond * 10) {
+		if time.Now().After(deadline) {
+			t.Fatalf("expect %s", what)
+		}
+	}
+}
+
+func TestSlaveStream(t *testing.T) {
+	master := NewGroup("streamed", 2<<10, GetterFunc(func(key string) ([]byte, error) { return nil, nil }),
+		GroupWithMode(ModeMaster))
+	for _, key := range []string{"a", "b", "c"} {
+		_, _ = master.Get(key)
+	}
+	conn := dialWorkServer(t)
+
+	local := &Group{name: "streamed", getter: GetterFunc(func(key string) ([]byte, error) { return []byte("value " + key), nil }),
+		batchSymbols: 3, batchWindow: time.Millisecond * 20}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go NewSlave("streaming", "", local, 2).RunStream(ctx, conn)
+
+	waitFor(t, "every key to be refreshed", func() bool { return master.queue.Len() == 0 })
+	for _, key := range []string{"a", "b", "c"} {
+		if v, ok := master.mainCache.peek(key); !ok || v.String() != "value "+key {
+			t.Fatalf("expect the streamed value of %s to be cached, but %q got", key, v)
+		}
+	}
+	for _, s := range slaves.Stats() {
+		if s.ID == "streaming" && (s.Fetched < 3 || !s.Alive) {
+			t.Fatalf("expect the keys fetched by a live slave, but %+v got", s)
+		}
+	}
+}
+
+func TestSlaveStreamCredit(t *testing.T) {
+	master := NewGroup("credited", 2<<10, GetterFunc(func(key string) ([]byte, error) { return nil, nil }),
+		GroupWithMode(ModeMaster))
+	for _, key := range []string{"a", "b", "c"} {
+		_, _ = master.Get(key)
+	}
+	conn := dialWorkServer(t)
+
+	blocked := make(chan struct{})
+	defer close(blocked)
+	local := &Group{name: "credited", getter: GetterFunc(func(key string) ([]byte, error) {
+		<-blocked
+		return []byte(key), nil
+	})}
+	ctx, cancel := context.WithCancel(context.Background())
+	go NewSlave("credit", "", local, 1).RunStream(ctx, conn)
+
+	waitFor(t, "a key to be leased", func() bool { return master.QueueStats().Leased == 1 })
+	time.Sleep(time.Millisecond * 50)
+	if stats := master.QueueStats(); stats.Leased != 1 || stats.Ready != 2 {
+		t.Fatalf("expect a single key leased with a credit of 1, but %+v got", stats)
+	}
+	// the lease of a slave going away is released at once
+	cancel()
+	waitFor(t, "the lease to be released", func() bool { return master.QueueStats().Ready == 3 })
+}
+
+func TestSlaveStreamCancel(t *testing.T) {
+	ConfigureUpstreams(UpstreamConfig{Retry: utils.RetryPolicy{Attempts: 1}, BreakerThreshold: 100})
+	defer ConfigureUpstreams(DefaultUpstreamConfig)
+	aborted := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		select {
+		case aborted <- struct{}{}:
+		default:
+		}
+	}))
+	defer srv.Close()
+
+	master := NewGroup("cancelled", 2<<10, GetterFunc(func(key string) ([]byte, error) { return nil, nil }),
+		GroupWithMode(ModeMaster), GroupWithQueue(QueueConfig{Capacity: 10, Visibility: time.Millisecond * 100, MaxAttempts: 3}))
+	_, _ = master.Get("sz000001")
+	conn := dialWorkServer(t)
+
+	sina := NewSinaProvider()
+	sina.api = srv.URL + "/list="
+	local := &Group{name: "cancelled", provider: sina, batchSymbols: 1}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go NewSlave("cancelling", "", local, 1).RunStream(ctx, conn)
+
+	// the lease expires long before the upstream request times out
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatal("expect the cancelled lease to abort its upstream request")
+	}
+}
+
+func TestSlaveStreamReconnect(t *testing.T) {
+	master := NewGroup("reconnected", 2<<10, GetterFunc(func(key string) ([]byte, error) { return nil, nil }),
+		GroupWithMode(ModeMaster), GroupWithQueue(QueueConfig{Capacity: 10, Visibility: time.Minute, MaxAttempts: 3}))
+	_, _ = master.Get("a")
+	client := pb.NewWorkClient(dialWorkServer(t))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	open := func(credit int32) pb.Work_RefreshClient {
+		stream, err := client.Refresh(ctx)
+		if err != nil {
+			t.Fatalf("open stream failed, error: %s", err.Error())
+		}
+		hello := &pb.Hello{Slave: "reconnecting", Group: "reconnected", Credit: credit}
+		if err := stream.Send(&pb.SlaveMessage{Body: &pb.SlaveMessage_Hello{Hello: hello}}); err != nil {
+			t.Fatalf("send hello failed, error: %s", err.Error())
+		}
+		return stream
+	}
+
+	// the slave reconnects before the master noticed its old stream broke
+	old := open(0)
+	stream := open(1)
+	msg, err := stream.Recv()
+	if err != nil || msg.GetAssignment() == nil {
+		t.Fatalf("expect a assigned on the new stream, error: %v", err)
+	}
+	_ = old.CloseSend()
+	if _, err := old.Recv(); err != io.EOF {
+		t.Fatalf("expect the old stream closed, but %v got", err)
+	}
+	if !master.queue.Leased(msg.GetAssignment().Lease) {
+		t.Fatal("expect the lease of the new stream to outlive the old stream")
+	}
+}
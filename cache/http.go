@@ -1,36 +1,139 @@
 package cache
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"stock_data_cache/utils"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const defaultBasePath = "/cache/"
+const klineBasePath = "/kline/"
+
+// versionHeader carries the version of a cached value in responses.
+const versionHeader = "X-Cache-Version"
+
+// leaseHeader carries the lease token of a missed key, see Group.LeaseMissed.
+const leaseHeader = "X-Lease-Token"
+const adminQueuePath = "/admin/queue"
+const adminSlavesPath = "/admin/slaves"
+const slavesBasePath = "/slaves/"
+const adminReplicationPath = "/admin/replication"
+const adminPromotePath = "/admin/promote"
+const adminEntryPath = "/admin/entry"
+
+// peerHeader marks requests a peer forwards to the owner of their key.
+const peerHeader = "X-Cache-Peer"
+const defaultReplicas = 50
 const Sina = "sina"
 
+// UpdateCacheRequest is the body of a cache update. Version is the unix
+// nanoseconds the value was fetched at, updates without one are versioned by
+// the time they are received. Updates older than the cached value are rejected,
+// and if ExpectedVersion is set the update is only made if it matches the
+// cached version, 0 meaning the key isn't cached. Lease is the token the key
+// was leased with, a successful update acknowledges it. Slave is the ID of
+// the slave sending the update, if any.
 type UpdateCacheRequest struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	Key             string `json:"key"`
+	Value           string `json:"value"`
+	Version         int64  `json:"version,omitempty"`
+	ExpectedVersion *int64 `json:"expected_version,omitempty"`
+	Lease           string `json:"lease,omitempty"`
+	Slave           string `json:"slave,omitempty"`
 }
 
 // HTTPPool implements PeerPicker for a pool of HTTP peers.
 type HTTPPool struct {
 	// this peer's base URL, e.g. "https://example.net:8000"
-	self     string
-	basePath string
+	self        string
+	basePath    string
+	replicas    int
+	mu          sync.Mutex // guards peers and httpGetters
+	peers       *utils.HashRing
+	httpGetters map[string]*httpGetter // keyed by e.g. "http://10.0.0.2:8008"
+	election    *Election
+}
+
+// An HTTPPoolOption configures an HTTPPool.
+type HTTPPoolOption func(*HTTPPool)
+
+// HTTPPoolWithReplicas sets the number of virtual nodes of each peer on the
+// hash ring, more spread keys more evenly.
+func HTTPPoolWithReplicas(replicas int) HTTPPoolOption {
+	return func(p *HTTPPool) {
+		p.replicas = replicas
+	}
+}
+
+// HTTPPoolWithElection serves election messages to e, and redirects writes
+// to the leader while this node follows.
+func HTTPPoolWithElection(e *Election) HTTPPoolOption {
+	return func(p *HTTPPool) {
+		p.election = e
+	}
 }
 
 // NewHTTPPool initializes an HTTP pool of peers.
-func NewHTTPPool(self string) *HTTPPool {
-	return &HTTPPool{
+func NewHTTPPool(self string, opts ...HTTPPoolOption) *HTTPPool {
+	p := &HTTPPool{
 		self:     self,
 		basePath: defaultBasePath,
+		replicas: defaultReplicas,
+	}
+	for _, opt := range opts {
+		opt(p)
 	}
+	return p
 }
 
+// Set updates the pool's list of peers, self included, by their base URLs.
+func (p *HTTPPool) Set(peers ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.peers = utils.NewHashRing(p.replicas, nil)
+	p.peers.Add(peers...)
+	p.httpGetters = make(map[string]*httpGetter, len(peers))
+	for _, peer := range peers {
+		p.httpGetters[peer] = &httpGetter{baseURL: strings.TrimRight(peer, "/") + p.basePath}
+	}
+}
+
+// owner returns the base URL of the peer owning key, or "" if it is self.
+func (p *HTTPPool) owner(key string) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.peers == nil {
+		return ""
+	}
+	if peer := p.peers.Get(key); peer != p.self {
+		return peer
+	}
+	return ""
+}
+
+// PickPeer picks a peer according to key
+func (p *HTTPPool) PickPeer(key string) (PeerGetter, bool) {
+	peer := p.owner(key)
+	if peer == "" {
+		return nil, false
+	}
+	p.Log("Pick peer %s", peer)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.httpGetters[peer], true
+}
+
+var _ PeerPicker = (*HTTPPool)(nil)
+
 // Log info with server name
 func (p *HTTPPool) Log(format string, v ...interface{}) {
 	log.Printf("[Server %s] %s", p.self, fmt.Sprintf(format, v...))
@@ -44,8 +147,60 @@ func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// /<basepath>/<groupname>?key=...
 	fmt.Printf("receive request, method: %s, path: %s\n", r.Method, r.URL.Path)
+	if r.URL.Path == metricsPath {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = metrics.WriteTo(w)
+		return
+	}
+	if r.URL.Path == adminQueuePath {
+		p.serveQueue(w, r)
+		return
+	}
+	if r.URL.Path == adminSlavesPath {
+		reapSlaves()
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(slaves.Stats()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	if r.URL.Path == adminEntryPath {
+		p.serveEntry(w, r)
+		return
+	}
+	if r.URL.Path == adminReplicationPath {
+		p.serveReplication(w, r)
+		return
+	}
+	if r.URL.Path == adminPromotePath {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		seq := Promote()
+		p.Log("promoted to primary at seq %d", seq)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"role": Role(), "seq": seq})
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, electionBasePath) {
+		p.serveElection(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, slavesBasePath) {
+		if p.redirectToLeader(w, r) {
+			return
+		}
+		p.serveSlave(w, r)
+		return
+	}
+	if strings.HasPrefix(r.URL.Path, klineBasePath) {
+		p.serveKLine(w, r)
+		return
+	}
 	if !strings.HasPrefix(r.URL.Path, p.basePath) {
 		http.Error(w, "unexpected path: "+r.URL.Path, http.StatusNotFound)
+		return
 	}
 
 	if strings.Contains(r.URL.Path[len(p.basePath):], "/") {
@@ -59,18 +214,72 @@ func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if _, ok := r.URL.Query()["missed"]; ok {
+	_, missed := r.URL.Query()["missed"]
+	if (missed || r.Method == "POST" || r.Method == "DELETE") && p.redirectToLeader(w, r) {
+		return
+	}
+
+	if missed && r.URL.Query().Get("batch") != "" {
+		// get a batch of missed keys as json leases
+		symbols, err := strconv.Atoi(r.URL.Query().Get("batch"))
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		leases := group.LeaseBatch(r.URL.Query().Get("slave"), symbols)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if err := json.NewEncoder(w).Encode(leases); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if missed {
 		// get missed
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		select {
-		case key := <-group.mainCache.missedChan:
-			fmt.Printf("missed channel length: %d\n", len(group.mainCache.missedChan))
-			_, err := w.Write([]byte(key))
+		if lease, ok := group.LeaseMissed(r.URL.Query().Get("slave")); ok {
+			fmt.Printf("missed leased, key: %s, attempts: %d\n", lease.Key, lease.Attempts)
+			w.Header().Set(leaseHeader, lease.Token)
+			_, err := w.Write([]byte(lease.Key))
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-		default:
+		}
+		w.WriteHeader(200)
+		return
+	}
+
+	if (r.Method == "POST" || r.Method == "DELETE") && Role() == RoleReplica {
+		http.Error(w, "read-only replica of "+Primary(), http.StatusForbidden)
+		return
+	}
+
+	if _, nack := r.URL.Query()["nack"]; nack && r.Method == "POST" {
+		// report a failed refresh, the key stays with the node that leased it
+		var params NackRequest
+		if err := json.NewDecoder(r.Body).Decode(&params); err != nil || params.Lease == "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if !group.nack(params) {
+			http.Error(w, "no such lease: "+params.Lease, http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(200)
+		return
+	}
+
+	if r.Method == "DELETE" {
+		// invalidate cache
+		key := r.URL.Query().Get("key")
+		if key == "" {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		if !group.Invalidate(key) {
+			http.Error(w, "no such key: "+key, http.StatusNotFound)
+			return
 		}
 		w.WriteHeader(200)
 		return
@@ -85,8 +294,21 @@ func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		fmt.Printf("update cache succeed, key: %s, value: %s\n", params.Key, params.Value)
-		group.populateCache(params.Key, ByteView{b: cloneBytes([]byte(params.Value))})
+		if owner := p.owner(params.Key); owner != "" && r.Header.Get(peerHeader) == "" {
+			p.forwardUpdate(w, owner, group, params)
+			return
+		}
+		version, err := group.update(params)
+		var rejectedErr *RejectedError
+		if errors.As(err, &rejectedErr) {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.Header().Set(versionHeader, strconv.FormatInt(version, 10))
 		w.WriteHeader(200)
 		return
 	}
@@ -99,13 +321,16 @@ func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	key := keys[0]
 
-	view, err := group.Get(key)
+	view, err := group.get(key, r.Header.Get(peerHeader) == "")
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if version, ok := group.mainCache.version(key); ok {
+		w.Header().Set(versionHeader, strconv.FormatInt(version, 10))
+	}
 	_, err = w.Write(view.ByteSlice())
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -113,3 +338,233 @@ func (p *HTTPPool) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 	w.WriteHeader(200)
 }
+
+// forwardUpdate sends an update to the peer owning its key and relays the
+// response status. The key may have been leased here, e.g. when its owner
+// was down, so a successful update acknowledges it here too.
+func (p *HTTPPool) forwardUpdate(w http.ResponseWriter, owner string, group *Group, params UpdateCacheRequest) {
+	b, _ := json.Marshal(params)
+	u := strings.TrimRight(owner, "/") + p.basePath + url.PathEscape(group.name)
+	_, err := utils.DoPostRequest(u, FetchTimeout, bytes.NewReader(b), utils.RequestWithHeaders(map[string]string{peerHeader: "1"}))
+	var statusErr *utils.StatusError
+	switch {
+	case errors.As(err, &statusErr):
+		http.Error(w, err.Error(), statusErr.Code)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		group.ack(params.Key, params.Lease)
+		w.WriteHeader(200)
+	}
+}
+
+// redirectToLeader redirects a write to the leader if this node follows, it
+// reports whether the request was answered. Leasing missed keys and slave
+// registrations count as writes since only the leader's queue is drained.
+func (p *HTTPPool) redirectToLeader(w http.ResponseWriter, r *http.Request) bool {
+	if p.election == nil || p.election.IsLeader() {
+		return false
+	}
+	leader := p.election.Leader()
+	if leader == "" {
+		http.Error(w, "no leader elected", http.StatusServiceUnavailable)
+		return true
+	}
+	http.Redirect(w, r, strings.TrimRight(leader, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+	return true
+}
+
+// serveElection handles the election messages at /election/vote and
+// /election/heartbeat, and GET /election/status with this node's view of the
+// election.
+func (p *HTTPPool) serveElection(w http.ResponseWriter, r *http.Request) {
+	if p.election == nil {
+		http.Error(w, "election disabled", http.StatusNotFound)
+		return
+	}
+	var resp interface{}
+	switch message := r.URL.Path[len(electionBasePath):]; {
+	case message == "status" && r.Method == http.MethodGet:
+		term, state := p.election.Status()
+		resp = map[string]interface{}{"term": term, "state": state, "leader": p.election.Leader()}
+	case message == "vote" && r.Method == http.MethodPost:
+		var req VoteRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		resp = p.election.HandleVote(req)
+	case message == "heartbeat" && r.Method == http.MethodPost:
+		var req HeartbeatRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		resp = p.election.HandleHeartbeat(req)
+	default:
+		http.Error(w, "unexpected path: "+r.URL.Path, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveReplication handles the pulls of replicas:
+// /admin/replication?epoch=...&since=<seq>&limit=<n> with the writes after
+// seq, or 410 if they are not kept anymore, and /admin/replication?snapshot=1
+// with the whole cache. Without parameters it returns the node's role.
+func (p *HTTPPool) serveReplication(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var resp interface{}
+	switch {
+	case query.Get("snapshot") != "":
+		resp = snapshot()
+	case query.Get("since") != "":
+		since, err := strconv.ParseUint(query.Get("since"), 10, 64)
+		if err != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		limit, err := strconv.Atoi(query.Get("limit"))
+		if err != nil || limit <= 0 {
+			limit = replicationBatch
+		}
+		ops, ok := replication.Since(query.Get("epoch"), since, limit)
+		if !ok {
+			http.Error(w, "writes after "+query.Get("since")+" are gone", http.StatusGone)
+			return
+		}
+		epoch, seq := replication.Seq()
+		resp = ReplicationResponse{Epoch: epoch, Seq: seq, Ops: ops}
+	default:
+		epoch, seq := replication.Seq()
+		resp = map[string]interface{}{"role": Role(), "primary": Primary(), "epoch": epoch, "seq": seq}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveQueue handles /admin/queue?group=<groupname> with the group's queue
+// stats and dead letters as json.
+func (p *HTTPPool) serveQueue(w http.ResponseWriter, r *http.Request) {
+	groupName := r.URL.Query().Get("group")
+	group := GetGroup(groupName)
+	if group == nil {
+		http.Error(w, "no such group: "+groupName, http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(group.QueueStats()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveEntry serves /admin/entry?group=...&key=... with the cached value's
+// metadata and queue state of key, see Group.Entry.
+func (p *HTTPPool) serveEntry(w http.ResponseWriter, r *http.Request) {
+	groupName := r.URL.Query().Get("group")
+	group := GetGroup(groupName)
+	if group == nil {
+		http.Error(w, "no such group: "+groupName, http.StatusNotFound)
+		return
+	}
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(group.Entry(key)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// serveSlave handles the registrations at /slaves/register and heartbeats
+// at /slaves/heartbeat of slaves, heartbeats of unknown slaves get a 404 to
+// make them register again.
+func (p *HTTPPool) serveSlave(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var params SlaveRequest
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil || params.ID == "" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	switch r.URL.Path[len(slavesBasePath):] {
+	case "register":
+		slaves.Register(params.ID, params.Capabilities)
+		fmt.Printf("slave registered, id: %s, capabilities: %v\n", params.ID, params.Capabilities)
+	case "heartbeat":
+		if !slaves.Heartbeat(params.ID) {
+			http.Error(w, "unknown slave: "+params.ID, http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "unexpected path: "+r.URL.Path, http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(200)
+}
+
+// serveKLine handles /kline/<groupname>?symbol=sz000001&scale=240&from=...&to=...
+// where from and to are dates or "2006-01-02 15:04:05" times, both optional.
+func (p *HTTPPool) serveKLine(w http.ResponseWriter, r *http.Request) {
+	groupName := r.URL.Path[len(klineBasePath):]
+	group := GetKLineGroup(groupName)
+	if group == nil {
+		http.Error(w, "no such group: "+groupName, http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	scale, err := strconv.Atoi(query.Get("scale"))
+	if err != nil || !validScale(scale) {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	var from, to time.Time
+	for param, t := range map[string]*time.Time{"from": &from, "to": &to} {
+		if v := query.Get(param); v != "" {
+			if *t, err = parseQueryTime(v); err != nil {
+				http.Error(w, "bad request", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	bars, err := group.Range(query.Get("symbol"), scale, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	if err := json.NewEncoder(w).Encode(bars); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func parseQueryTime(v string) (time.Time, error) {
+	if len(v) == len("2006-01-02") {
+		return time.ParseInLocation("2006-01-02", v, chinaZone)
+	}
+	return time.ParseInLocation("2006-01-02 15:04:05", v, chinaZone)
+}
+
+// httpGetter gets values from a peer over HTTP.
+type httpGetter struct {
+	baseURL string
+}
+
+// Get implements PeerGetter
+func (h *httpGetter) Get(group string, key string) ([]byte, error) {
+	u := fmt.Sprintf("%v%v?key=%v", h.baseURL, url.PathEscape(group), url.QueryEscape(key))
+	return utils.DoGetRequest(u, FetchTimeout, utils.RequestWithHeaders(map[string]string{peerHeader: "1"}))
+}
+
+var _ PeerGetter = (*httpGetter)(nil)
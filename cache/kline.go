@@ -0,0 +1,226 @@
+package cache
+
+import (
+	"fmt"
+	"golang.org/x/sync/singleflight"
+	"sort"
+	"sync"
+	"time"
+)
+
+const KLine = "kline"
+
+// MaxBars is the number of bars fetched for a series not cached yet.
+const MaxBars = 1023
+
+// MaxSeriesBars bounds the bars kept per series, the oldest are dropped
+// first.
+const MaxSeriesBars = MaxBars * 4
+
+// KLineScales are the scales upstreams serve bars at, in minutes.
+var KLineScales = []int{5, 15, 30, 60, 240}
+
+// barSize is roughly the memory a Bar takes.
+const barSize = 64
+
+// A Bar is one k-line bar, Time is the date of a daily bar and the end of
+// the period of a minute bar.
+type Bar struct {
+	Time   time.Time `json:"time"`
+	Open   float64   `json:"open"`
+	High   float64   `json:"high"`
+	Low    float64   `json:"low"`
+	Close  float64   `json:"close"`
+	Volume float64   `json:"volume"`
+}
+
+// A BarFetcher fetches the latest count bars of a symbol, scale is the
+// period of a bar in minutes, 240 for daily bars.
+type BarFetcher interface {
+	FetchBars(symbol string, scale, count int, timeout time.Duration) ([]Bar, error)
+}
+
+// series caches the bars of one symbol and scale. Every bar but the last is
+// complete and never changes, the last one is replaced by each refresh.
+type series struct {
+	bars    []Bar
+	updated time.Time
+}
+
+// Len implements Value
+func (s *series) Len() int {
+	return len(s.bars) * barSize
+}
+
+// merge appends fetched bars newer than the complete bars of s, which keeps
+// them and drops its tail bar, and keeps the latest MaxSeriesBars of them.
+func (s *series) merge(fetched []Bar) {
+	complete := s.bars
+	if len(complete) > 0 {
+		complete = complete[:len(complete)-1]
+	}
+	bars := make([]Bar, len(complete), len(complete)+len(fetched))
+	copy(bars, complete)
+	for _, b := range fetched {
+		if len(bars) == 0 || b.Time.After(bars[len(bars)-1].Time) {
+			bars = append(bars, b)
+		}
+	}
+	if len(bars) > MaxSeriesBars {
+		bars = bars[len(bars)-MaxSeriesBars:]
+	}
+	s.bars = bars
+}
+
+// A KLineGroup caches k-line bars per symbol and scale. Complete bars are
+// kept until their series is evicted, only the tail of a series is
+// refreshed once it expires.
+type KLineGroup struct {
+	name     string
+	fetcher  BarFetcher
+	calendar *Calendar
+	mu       sync.Mutex
+	series   *Cache // of *series, by least recently used
+	sg       *singleflight.Group
+}
+
+var klineGroups = make(map[string]*KLineGroup)
+
+// NewKLineGroup create a new instance of KLineGroup keeping up to cacheBytes
+// of bars, calendar may be nil to refresh tails after ExpireMinutes.
+func NewKLineGroup(name string, cacheBytes int64, fetcher BarFetcher, calendar *Calendar) *KLineGroup {
+	if fetcher == nil {
+		panic("nil BarFetcher")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	g := &KLineGroup{
+		name:     name,
+		fetcher:  fetcher,
+		calendar: calendar,
+		series:   New(cacheBytes, nil),
+		sg:       &singleflight.Group{},
+	}
+	klineGroups[name] = g
+	return g
+}
+
+// GetKLineGroup returns the named group previously created with
+// NewKLineGroup, or nil if there's no such group.
+func GetKLineGroup(name string) *KLineGroup {
+	mu.RLock()
+	g := klineGroups[name]
+	mu.RUnlock()
+	return g
+}
+
+// Range returns the bars of symbol at scale with times in [from, to], a zero
+// from or to leaves that end open.
+func (g *KLineGroup) Range(symbol string, scale int, from, to time.Time) ([]Bar, error) {
+	if _, _, err := splitSymbol(symbol); err != nil {
+		return nil, err
+	}
+	if !validScale(scale) {
+		return nil, fmt.Errorf("invalid scale: %d", scale)
+	}
+	bars, err := g.load(symbol, scale)
+	if err != nil {
+		return nil, err
+	}
+	start := sort.Search(len(bars), func(i int) bool { return !bars[i].Time.Before(from) })
+	end := len(bars)
+	if !to.IsZero() {
+		end = sort.Search(len(bars), func(i int) bool { return bars[i].Time.After(to) })
+	}
+	if start >= end {
+		return []Bar{}, nil
+	}
+	result := make([]Bar, end-start)
+	copy(result, bars[start:end])
+	return result, nil
+}
+
+// load returns the cached bars, refreshing the tail first if it expired.
+func (g *KLineGroup) load(symbol string, scale int) ([]Bar, error) {
+	key := fmt.Sprintf("%s:%d", symbol, scale)
+	g.mu.Lock()
+	cached, ok := g.series.Get(key)
+	if ok && !g.expired(symbol, cached.(*series).updated) {
+		bars := cached.(*series).bars
+		g.mu.Unlock()
+		return bars, nil
+	}
+	g.mu.Unlock()
+
+	v, err, _ := g.sg.Do(key, func() (interface{}, error) {
+		return g.refresh(key, symbol, scale)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]Bar), nil
+}
+
+// refresh fetches enough bars to cover the series' tail, or its whole
+// history if it isn't cached yet, and merges them in. If the fetched bars
+// don't reach back to the cached tail, e.g. after a long halt, the bars in
+// between are missing and the series starts over from its whole history.
+func (g *KLineGroup) refresh(key, symbol string, scale int) ([]Bar, error) {
+	count := MaxBars
+	var cached []Bar
+	g.mu.Lock()
+	if v, ok := g.series.Peek(key); ok && len(v.(*series).bars) > 0 {
+		cached = v.(*series).bars
+		period := time.Duration(scale) * time.Minute
+		if scale >= 240 {
+			period = time.Hour * 24
+		}
+		// one more bar than elapsed periods so the old tail is fetched again
+		count = int(time.Since(cached[len(cached)-1].Time)/period) + 2
+		if count > MaxBars {
+			count = MaxBars
+		}
+	}
+	g.mu.Unlock()
+
+	fetched, err := g.fetcher.FetchBars(symbol, scale, count, FetchTimeout)
+	if err == nil && len(cached) > 0 && len(fetched) > 0 && fetched[0].Time.After(cached[len(cached)-1].Time) {
+		fmt.Printf("bars gap, group: %s, key: %s, cached until: %s, fetched from: %s\n",
+			g.name, key, cached[len(cached)-1].Time, fetched[0].Time)
+		cached = nil
+		if count < MaxBars {
+			fetched, err = g.fetcher.FetchBars(symbol, scale, MaxBars, FetchTimeout)
+		}
+	}
+	if err != nil {
+		fmt.Printf("fetch bars failed, group: %s, key: %s, error: %s\n", g.name, key, err.Error())
+		return nil, err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	// a new series, so that the cache accounts for the bars added
+	s := &series{bars: cached}
+	s.merge(fetched)
+	s.updated = time.Now()
+	g.series.Add(key, s)
+	fmt.Printf("refresh bars done, group: %s, key: %s, fetched: %d, total: %d\n", g.name, key, len(fetched), len(s.bars))
+	return s.bars, nil
+}
+
+// validScale reports whether scale is one of KLineScales.
+func validScale(scale int) bool {
+	for _, s := range KLineScales {
+		if s == scale {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *KLineGroup) expired(symbol string, updated time.Time) bool {
+	if g.calendar != nil {
+		return !time.Now().Before(g.calendar.Expiry(marketOf(symbol), updated))
+	}
+	return int(time.Now().Sub(updated).Minutes()) >= ExpireMinutes
+}
@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+// fakeBars serves daily bars ending at last, the last bar closing at close.
+type fakeBars struct {
+	last   time.Time
+	close  float64
+	counts []int
+}
+
+func (f *fakeBars) FetchBars(symbol string, scale, count int, timeout time.Duration) ([]Bar, error) {
+	f.counts = append(f.counts, count)
+	bars := make([]Bar, 0, count)
+	for i := count - 1; i >= 0; i-- {
+		bars = append(bars, Bar{Time: f.last.AddDate(0, 0, -i), Close: float64(100 - i)})
+	}
+	bars[len(bars)-1].Close = f.close
+	return bars, nil
+}
+
+func TestKLineGroup(t *testing.T) {
+	today := time.Now().In(chinaZone).Truncate(time.Hour * 24)
+	fetcher := &fakeBars{last: today, close: 1}
+	g := NewKLineGroup("kline", 2<<20, fetcher, nil)
+
+	bars, err := g.Range("sz000001", 240, time.Time{}, time.Time{})
+	if err != nil || len(bars) != MaxBars || fetcher.counts[0] != MaxBars {
+		t.Fatalf("expect full history on first load, but %d bars, error: %v", len(bars), err)
+	}
+	if _, err := g.Range("sz000001", 240, time.Time{}, time.Time{}); err != nil || len(fetcher.counts) != 1 {
+		t.Fatal("expect cached series not to be refetched before it expires")
+	}
+
+	// the tail bar changes and a new bar arrives, history must not be touched
+	cached, _ := g.series.Peek("sz000001:240")
+	cached.(*series).updated = time.Now().Add(-time.Minute * ExpireMinutes)
+	cached.(*series).bars[0].Close = -1
+	fetcher.last, fetcher.close = today.AddDate(0, 0, 1), 2
+	bars, err = g.Range("sz000001", 240, today.AddDate(0, 0, -1), time.Time{})
+	if err != nil || fetcher.counts[1] > 3 {
+		t.Fatalf("expect only the tail to be fetched, but %v, error: %v", fetcher.counts, err)
+	}
+	if len(bars) != 3 || bars[1].Close != 99 || bars[2].Close != 2 || !bars[2].Time.Equal(fetcher.last) {
+		t.Fatalf("expect merged tail, but %+v got", bars)
+	}
+	if all, _ := g.Range("sz000001", 240, time.Time{}, time.Time{}); len(all) != MaxBars+1 || all[0].Close != -1 {
+		t.Fatal("expect complete bars to be kept as they are")
+	}
+
+	// bars missed since the cached tail are more than the tail fetch covers
+	cached, _ = g.series.Peek("sz000001:240")
+	cached.(*series).updated = time.Now().Add(-time.Minute * ExpireMinutes)
+	fetcher.last = today.AddDate(0, 0, MaxBars*2)
+	fetcher.counts = nil
+	bars, err = g.Range("sz000001", 240, time.Time{}, time.Time{})
+	if err != nil || len(fetcher.counts) != 2 || fetcher.counts[1] != MaxBars {
+		t.Fatalf("expect the whole history to be fetched again, but %v, error: %v", fetcher.counts, err)
+	}
+	if len(bars) != MaxBars || !bars[0].Time.Equal(fetcher.last.AddDate(0, 0, 1-MaxBars)) {
+		t.Fatalf("expect the series without a hole, but %d bars from %s got", len(bars), bars[0].Time)
+	}
+
+	if _, err := g.Range("xx000001", 240, time.Time{}, time.Time{}); err == nil {
+		t.Fatal("expect invalid symbol to be rejected")
+	}
+	if _, err := g.Range("sz000001", 7, time.Time{}, time.Time{}); err == nil {
+		t.Fatal("expect a scale upstreams don't serve to be rejected")
+	}
+}
+
+func TestKLineGroupBounds(t *testing.T) {
+	today := time.Now().In(chinaZone).Truncate(time.Hour * 24)
+	fetcher := &fakeBars{last: today, close: 1}
+	// room for about two full series
+	g := NewKLineGroup("bounded", MaxBars*barSize*5/2, fetcher, nil)
+	for _, symbol := range []string{"sz000001", "sz000002"} {
+		_, _ = g.Range(symbol, 240, time.Time{}, time.Time{})
+	}
+	_, _ = g.Range("sz000001", 240, time.Time{}, time.Time{})
+	_, _ = g.Range("sz000003", 240, time.Time{}, time.Time{})
+	if _, ok := g.series.Peek("sz000002:240"); ok || g.series.Len() != 2 {
+		t.Fatalf("expect the least recently used series evicted, but %d cached", g.series.Len())
+	}
+
+	s := &series{}
+	for i := 0; i < 5; i++ {
+		bars := make([]Bar, MaxBars)
+		for j := range bars {
+			bars[j].Time = today.AddDate(0, 0, i*MaxBars+j)
+		}
+		s.merge(bars)
+	}
+	if len(s.bars) != MaxSeriesBars || !s.bars[len(s.bars)-1].Time.Equal(today.AddDate(0, 0, 5*MaxBars-1)) {
+		t.Fatalf("expect the latest %d bars kept, but %d got", MaxSeriesBars, len(s.bars))
+	}
+}
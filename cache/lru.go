@@ -2,7 +2,6 @@ package cache
 
 import (
 	"container/list"
-	"fmt"
 	"time"
 )
 
@@ -20,6 +19,11 @@ type entry struct {
 	key       string
 	value     Value
 	timestamp time.Time
+	// version orders writes of a key, e.g. by the time its value was fetched
+	version int64
+	// hits counts the lookups of the key, accessed is the time of the last one
+	hits     int64
+	accessed time.Time
 }
 
 // Value use Len to count how many bytes it takes
@@ -37,16 +41,28 @@ func New(maxBytes int64, onEvicted func(string, Value)) *Cache {
 	}
 }
 
-// Add adds a value to the cache.
+// Add adds a value to the cache, versioned by the current time.
 func (c *Cache) Add(key string, value Value) {
+	c.AddVersion(key, value, time.Now().UnixNano())
+}
+
+// AddVersion adds a value with the given version to the cache.
+func (c *Cache) AddVersion(key string, value Value, version int64) {
+	c.addAt(key, value, version, time.Now())
+}
+
+// addAt adds a value with the given version, fetched at timestamp, e.g. on a
+// primary the value is replicated from.
+func (c *Cache) addAt(key string, value Value, version int64, timestamp time.Time) {
 	if ele, ok := c.cache[key]; ok {
 		c.ll.MoveToFront(ele)
 		kv := ele.Value.(*entry)
 		c.nBytes += int64(value.Len()) - int64(kv.value.Len())
 		kv.value = value
-		kv.timestamp = time.Now()
+		kv.timestamp = timestamp
+		kv.version = version
 	} else {
-		ele := c.ll.PushFront(&entry{key, value, time.Now()})
+		ele := c.ll.PushFront(&entry{key: key, value: value, timestamp: timestamp, version: version})
 		c.cache[key] = ele
 		c.nBytes += int64(len(key)) + int64(value.Len())
 	}
@@ -55,17 +71,44 @@ func (c *Cache) Add(key string, value Value) {
 	}
 }
 
+// restore adds an entry with its metadata behind the cached ones, e.g. from
+// a snapshot, unless its key is cached already.
+func (c *Cache) restore(e *entry) {
+	if _, ok := c.cache[e.key]; ok {
+		return
+	}
+	c.cache[e.key] = c.ll.PushBack(e)
+	c.nBytes += int64(len(e.key)) + int64(e.value.Len())
+	for c.maxBytes != 0 && c.maxBytes < c.nBytes {
+		c.RemoveOldest()
+	}
+}
+
+// Remove removes a key, it reports whether the key was cached
+func (c *Cache) Remove(key string) bool {
+	ele, ok := c.cache[key]
+	if !ok {
+		return false
+	}
+	c.removeElement(ele)
+	return true
+}
+
 // RemoveOldest removes the oldest item
 func (c *Cache) RemoveOldest() {
 	ele := c.ll.Back()
 	if ele != nil {
-		c.ll.Remove(ele)
-		kv := ele.Value.(*entry)
-		delete(c.cache, kv.key)
-		c.nBytes -= int64(len(kv.key)) + int64(kv.value.Len())
-		if c.OnEvicted != nil {
-			c.OnEvicted(kv.key, kv.value)
-		}
+		c.removeElement(ele)
+	}
+}
+
+func (c *Cache) removeElement(ele *list.Element) {
+	c.ll.Remove(ele)
+	kv := ele.Value.(*entry)
+	delete(c.cache, kv.key)
+	c.nBytes -= int64(len(kv.key)) + int64(kv.value.Len())
+	if c.OnEvicted != nil {
+		c.OnEvicted(kv.key, kv.value)
 	}
 }
 
@@ -78,12 +121,43 @@ func (c *Cache) Len() int {
 func (c *Cache) Get(key string) (value Value, ok bool) {
 	if ele, ok := c.cache[key]; ok {
 		c.ll.MoveToFront(ele)
-		if int(time.Now().Sub(ele.Value.(*entry).timestamp).Minutes()) >= ExpireMinutes {
-			fmt.Printf("cache timeout, key: %s\n", key)
-			g := GetGroup(Sina)
-			g.SendMissedCache(key)
-		}
+		kv := ele.Value.(*entry)
+		kv.hits++
+		kv.accessed = time.Now()
+		return kv.value, true
+	}
+	return
+}
+
+// Peek looks up a key's value without moving it to the front
+func (c *Cache) Peek(key string) (value Value, ok bool) {
+	if ele, ok := c.cache[key]; ok {
 		return ele.Value.(*entry).value, true
 	}
 	return
 }
+
+// Version returns the version of a key's value
+func (c *Cache) Version(key string) (version int64, ok bool) {
+	if ele, ok := c.cache[key]; ok {
+		return ele.Value.(*entry).version, true
+	}
+	return
+}
+
+// Timestamp returns when a key's value was last added
+func (c *Cache) Timestamp(key string) (timestamp time.Time, ok bool) {
+	if ele, ok := c.cache[key]; ok {
+		return ele.Value.(*entry).timestamp, true
+	}
+	return
+}
+
+// Usage returns how many times a key was looked up and when it was last
+func (c *Cache) Usage(key string) (hits int64, accessed time.Time, ok bool) {
+	if ele, ok := c.cache[key]; ok {
+		kv := ele.Value.(*entry)
+		return kv.hits, kv.accessed, true
+	}
+	return
+}
@@ -0,0 +1,100 @@
+package cache
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const metricsPath = "/metrics"
+
+// Metrics holds counters and gauges and writes them in the prometheus text
+// format. It is safe for concurrent access.
+type Metrics struct {
+	mu       sync.Mutex
+	counters map[string]float64
+	gauges   map[string]float64
+}
+
+// NewMetrics create a new instance of Metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		counters: make(map[string]float64),
+		gauges:   make(map[string]float64),
+	}
+}
+
+var metrics = NewMetrics()
+
+// DefaultMetrics returns the metrics every group reports to.
+func DefaultMetrics() *Metrics {
+	return metrics
+}
+
+// Inc increments a counter, labels are given as name, value pairs.
+func (m *Metrics) Inc(name string, labels ...string) {
+	m.Add(name, 1, labels...)
+}
+
+// Add adds delta to a counter.
+func (m *Metrics) Add(name string, delta float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[metricKey(name, labels)] += delta
+}
+
+// Set sets a gauge.
+func (m *Metrics) Set(name string, value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges[metricKey(name, labels)] = value
+}
+
+// Get returns the value of a counter or gauge.
+func (m *Metrics) Get(name string, labels ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := metricKey(name, labels)
+	if v, ok := m.gauges[key]; ok {
+		return v
+	}
+	return m.counters[key]
+}
+
+// WriteTo writes all metrics sorted by name.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	lines := make([]string, 0, len(m.counters)+len(m.gauges))
+	for key, v := range m.counters {
+		lines = append(lines, fmt.Sprintf("%s %g\n", key, v))
+	}
+	for key, v := range m.gauges {
+		lines = append(lines, fmt.Sprintf("%s %g\n", key, v))
+	}
+	m.mu.Unlock()
+
+	sort.Strings(lines)
+	var n int64
+	for _, line := range lines {
+		c, err := io.WriteString(w, line)
+		n += int64(c)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// metricKey renders name{k1="v1",k2="v2"}.
+func metricKey(name string, labels []string) string {
+	if len(labels) == 0 {
+		return name
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
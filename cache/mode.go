@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"stock_data_cache/utils"
+	"sync"
+	"time"
+)
+
+// A Mode is the role a process plays.
+type Mode string
+
+const (
+	// ModeMaster serves the cache and queues missed keys for slaves
+	ModeMaster Mode = "master"
+	// ModeSlave refreshes the missed keys of a master
+	ModeSlave Mode = "slave"
+	// ModeStandalone serves the cache and fetches missed keys itself
+	ModeStandalone Mode = "standalone"
+)
+
+// ParseMode returns the mode named s.
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(s); m {
+	case ModeMaster, ModeSlave, ModeStandalone:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown mode: %s", s)
+}
+
+// GroupWithMode sets how the group loads keys that aren't cached: a master
+// queues them for its slaves and fails, other modes fetch them at once.
+// Groups are standalone by default.
+func GroupWithMode(mode Mode) GroupOption {
+	return func(g *Group) {
+		g.mode = mode
+	}
+}
+
+// RunWorkers refreshes the keys in the group's own queue with workers until
+// ctx is done, the way slaves do for a master.
+func (g *Group) RunWorkers(ctx context.Context, workers int) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			update := g.UpdateMissed
+			if g.batchSymbols > 1 {
+				update = g.UpdateMissedBatch
+			}
+			for ctx.Err() == nil {
+				if empty, err := update(ctx); empty || err != nil {
+					sleep(ctx, time.Second)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// UpdateMissed leases a key from the group's own queue, fetches it and
+// caches the value. empty reports whether the queue had no key to refresh.
+// The fetch is aborted once ctx is done.
+func (g *Group) UpdateMissed(ctx context.Context) (empty bool, err error) {
+	if !g.available() {
+		return false, utils.ErrBreakerOpen
+	}
+	lease, ok := g.LeaseMissed("")
+	if !ok {
+		return true, nil
+	}
+
+	fetchedAt := time.Now()
+	value, err := g.fetch(ctx, lease.Key)
+	if err != nil {
+		fmt.Printf("fetch failed, group: %s, key: %s, error: %s\n", g.name, lease.Key, err.Error())
+		// keys given up on stay leased until the lease expires
+		if ctx.Err() == nil {
+			g.nack(newNack(lease, "", err))
+		}
+		return
+	}
+	return false, g.cacheMissed(lease, value, fetchedAt)
+}
+
+// UpdateMissedBatch leases a batch of keys from the group's own queue,
+// fetches them at once and caches their values, see GroupWithBatch. empty
+// reports whether the queue had no key to refresh.
+func (g *Group) UpdateMissedBatch(ctx context.Context) (empty bool, err error) {
+	if !g.available() {
+		return false, utils.ErrBreakerOpen
+	}
+	leases := g.LeaseBatch("", 0)
+	if len(leases) == 0 {
+		return true, nil
+	}
+
+	fetchedAt := time.Now()
+	values, errs := g.fetchBatch(ctx, leaseKeys(leases))
+	for _, lease := range leases {
+		if value, ok := values[lease.Key]; ok {
+			_ = g.cacheMissed(lease, value, fetchedAt)
+		} else if ctx.Err() == nil {
+			g.nack(newNack(lease, "", errs[lease.Key]))
+		}
+	}
+	if len(errs) > 0 {
+		err = fmt.Errorf("%d of %d keys failed", len(errs), len(leases))
+	}
+	return
+}
+
+// cacheMissed caches the value of a leased key fetched at fetchedAt and
+// acknowledges the lease.
+func (g *Group) cacheMissed(lease Lease, value []byte, fetchedAt time.Time) error {
+	err := g.populateCache(lease.Key, ByteView{b: cloneBytes(value)}, fetchedAt.UnixNano())
+	// a newer value is cached already, the key is as fresh as it gets
+	if errors.Is(err, ErrOutdated) || errors.Is(err, ErrStaleVersion) {
+		err = nil
+	}
+	if err != nil {
+		g.nack(newNack(lease, "", err))
+		return err
+	}
+	g.queue.Ack(lease.Token)
+	return nil
+}
+
+// leaseKeys returns the keys of leases.
+func leaseKeys(leases []Lease) []string {
+	keys := make([]string, 0, len(leases))
+	for _, lease := range leases {
+		keys = append(keys, lease.Key)
+	}
+	return keys
+}
@@ -0,0 +1,126 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"stock_data_cache/utils"
+	"time"
+)
+
+// Failure classes, see classify.
+const (
+	FailureTimeout     = "timeout"
+	FailureStatus      = "status"
+	FailureBreakerOpen = "breaker_open"
+	FailureEmpty       = "empty"
+	FailureBlocked     = "blocked"
+	FailureMalformed   = "malformed"
+	FailureRejected    = "rejected"
+	FailureOther       = "other"
+)
+
+// NackRequest is the body of a failure report: the worker with lease on key
+// couldn't refresh it. Class is one of the Failure classes.
+type NackRequest struct {
+	Key     string `json:"key"`
+	Lease   string `json:"lease"`
+	Slave   string `json:"slave,omitempty"`
+	Class   string `json:"class"`
+	Message string `json:"message"`
+}
+
+// classify returns the Failure class of an error refreshing a key.
+func classify(err error) string {
+	var payloadErr *PayloadError
+	var statusErr *utils.StatusError
+	var rejectedErr *RejectedError
+	var netErr net.Error
+	switch {
+	// a rejected value wraps the payload error of the sanity check that failed
+	case errors.As(err, &rejectedErr):
+		return FailureRejected
+	case errors.As(err, &payloadErr):
+		switch payloadErr.Kind {
+		case ErrEmpty:
+			return FailureEmpty
+		case ErrBlocked:
+			return FailureBlocked
+		case ErrMalformed:
+			return FailureMalformed
+		}
+	case errors.Is(err, utils.ErrBreakerOpen):
+		return FailureBreakerOpen
+	case errors.As(err, &statusErr):
+		return FailureStatus
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return FailureTimeout
+	}
+	return FailureOther
+}
+
+// keyFailure reports whether failures of class are the key's own fault, e.g.
+// a symbol the upstream has no data for, rather than the upstream's or the
+// network's. Only those quarantine a key, see WorkQueue.Nack.
+func keyFailure(class string) bool {
+	switch class {
+	case FailureEmpty, FailureMalformed, FailureRejected:
+		return true
+	}
+	return false
+}
+
+// newNack builds the failure report of err refreshing a leased key.
+func newNack(lease Lease, slave string, err error) NackRequest {
+	return NackRequest{Key: lease.Key, Lease: lease.Token, Slave: slave, Class: classify(err), Message: err.Error()}
+}
+
+// nack records a worker's failure to refresh a leased key, the key is retried
+// with backoff or quarantined, see WorkQueue.Nack. It returns false if the
+// lease is unknown, e.g. because it expired.
+func (g *Group) nack(params NackRequest) bool {
+	if params.Class == "" {
+		params.Class = FailureOther
+	}
+	metrics.Inc("refresh_failed_total", "group", g.name, "class", params.Class)
+	slaves.failed(params.Slave)
+	failure := Failure{Class: params.Class, Message: params.Message, Slave: params.Slave}
+	if _, ok := g.queue.Nack(params.Lease, failure); !ok {
+		fmt.Printf("unknown lease, group: %s, key: %s\n", g.name, params.Key)
+		return false
+	}
+	fmt.Printf("refresh failed, key: %s, class: %s, error: %s\n", params.Key, params.Class, params.Message)
+	return true
+}
+
+// EntryInfo is the admin view of a key: the metadata of its cached value, if
+// any, and its state in the group's queue with the last failure reported.
+type EntryInfo struct {
+	Key      string     `json:"key"`
+	Cached   bool       `json:"cached"`
+	Version  int64      `json:"version,omitempty"`
+	Fetched  *time.Time `json:"fetched,omitempty"`
+	Expired  bool       `json:"expired"`
+	Hits     int64      `json:"hits"`
+	Accessed *time.Time `json:"accessed,omitempty"`
+	Queue    KeyState   `json:"queue"`
+}
+
+// Entry returns the admin view of key.
+func (g *Group) Entry(key string) EntryInfo {
+	info := EntryInfo{Key: key, Queue: g.queue.State(key)}
+	timestamp, hits, accessed, ok := g.mainCache.usage(key)
+	if !ok {
+		return info
+	}
+	info.Cached = true
+	info.Version, _ = g.mainCache.version(key)
+	info.Fetched = &timestamp
+	info.Expired = g.expired(key, timestamp)
+	info.Hits = hits
+	if !accessed.IsZero() {
+		info.Accessed = &accessed
+	}
+	return info
+}
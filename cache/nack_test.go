@@ -0,0 +1,78 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"stock_data_cache/utils"
+	"testing"
+	"time"
+)
+
+func TestClassify(t *testing.T) {
+	cases := []struct {
+		err   error
+		class string
+	}{
+		{&PayloadError{Provider: Sina, Kind: ErrBlocked}, FailureBlocked},
+		{fmt.Errorf("sina: %w", &PayloadError{Provider: Sina, Kind: ErrEmpty}), FailureEmpty},
+		{&FailoverError{Providers: []string{Sina}, Errs: []error{&utils.StatusError{Code: 502}}}, FailureStatus},
+		{utils.ErrBreakerOpen, FailureBreakerOpen},
+		{&RejectedError{Err: ErrOutdated}, FailureRejected},
+		{&RejectedError{Err: &PayloadError{Provider: Sina, Kind: ErrOutOfLimit}}, FailureRejected},
+		{fmt.Errorf("unexpected"), FailureOther},
+	}
+	for _, c := range cases {
+		if class := classify(c.err); class != c.class {
+			t.Fatalf("expect %v classified as %s, but %s got", c.err, c.class, class)
+		}
+	}
+	if !keyFailure(classify(&RejectedError{Err: &PayloadError{Provider: Sina, Kind: ErrOutOfLimit}})) {
+		t.Fatalf("expect a rejected value to be the key's own failure")
+	}
+}
+
+func TestNack(t *testing.T) {
+	retry := utils.RetryPolicy{Attempts: 3, BaseDelay: time.Minute}
+	g := NewGroup("nack", 2<<10, GetterFunc(func(key string) ([]byte, error) { return []byte(key), nil }),
+		GroupWithQueue(QueueConfig{Capacity: 10, Visibility: time.Minute, MaxAttempts: 3, Retry: retry, Quarantine: time.Hour}))
+	p := NewHTTPPool("localhost")
+	g.SendMissedCache("a")
+	lease, _ := g.LeaseMissed("slave-1")
+
+	nack := func(req NackRequest) int {
+		b, _ := json.Marshal(req)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodPost, defaultBasePath+"nack?nack=1", bytes.NewReader(b)))
+		return w.Code
+	}
+	if code := nack(NackRequest{Key: "a"}); code != http.StatusBadRequest {
+		t.Fatalf("expect nack without a lease to be refused, but %d got", code)
+	}
+	req := NackRequest{Key: "a", Lease: lease.Token, Slave: "slave-1", Class: FailureStatus, Message: "status code: 502"}
+	if code := nack(req); code != http.StatusOK {
+		t.Fatalf("expect nack to succeed, but %d got", code)
+	}
+	if code := nack(req); code != http.StatusNotFound {
+		t.Fatalf("expect nack of an ended lease to fail, but %d got", code)
+	}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, adminEntryPath+"?group=nack&key=a", nil))
+	var entry EntryInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &entry); err != nil {
+		t.Fatalf("unexpected entry %s, error: %v", w.Body.String(), err)
+	}
+	if entry.Cached || entry.Queue.State != KeyDelayed || entry.Queue.LastFailure == nil ||
+		entry.Queue.LastFailure.Class != FailureStatus || entry.Queue.LastFailure.Slave != "slave-1" {
+		t.Fatalf("expect a delayed with its last failure, but %s got", w.Body.String())
+	}
+
+	// cached keys show the metadata of their value
+	_ = g.populateCache("b", ByteView{b: []byte("b")}, 1)
+	if entry := g.Entry("b"); !entry.Cached || entry.Version != 1 || entry.Queue.State != KeyIdle {
+		t.Fatalf("expect b cached and idle, but %+v got", entry)
+	}
+}
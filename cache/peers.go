@@ -0,0 +1,32 @@
+package cache
+
+// PeerPicker locates the peer that owns a specific key.
+type PeerPicker interface {
+	// PickPeer returns the peer owning key, ok is false if this node owns it
+	PickPeer(key string) (peer PeerGetter, ok bool)
+}
+
+// PeerGetter gets values from a peer.
+type PeerGetter interface {
+	Get(group string, key string) ([]byte, error)
+}
+
+// RegisterPeers registers a PeerPicker for choosing the remote peer owning
+// each key, keys this node doesn't own are got from their owners.
+func (g *Group) RegisterPeers(peers PeerPicker) {
+	if g.peers != nil {
+		panic("RegisterPeers called more than once")
+	}
+	g.peers = peers
+}
+
+// getFromPeer gets key from the peer owning it, the value isn't cached here.
+func (g *Group) getFromPeer(peer PeerGetter, key string) (ByteView, error) {
+	b, err := peer.Get(g.name, key)
+	if err != nil {
+		metrics.Inc("peer_requests_total", "group", g.name, "result", "error")
+		return ByteView{}, err
+	}
+	metrics.Inc("peer_requests_total", "group", g.name, "result", "ok")
+	return ByteView{b: b}, nil
+}
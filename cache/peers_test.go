@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"stock_data_cache/utils"
+	"strconv"
+	"testing"
+)
+
+func TestHashRing(t *testing.T) {
+	ring := utils.NewHashRing(3, func(key []byte) uint32 {
+		i, _ := strconv.Atoi(string(key))
+		return uint32(i)
+	})
+	// virtual nodes 2, 4, 6, 12, 14, 16, 22, 24, 26
+	ring.Add("6", "4", "2")
+	cases := map[string]string{"2": "2", "11": "2", "23": "4", "27": "2"}
+	for k, v := range cases {
+		if node := ring.Get(k); node != v {
+			t.Fatalf("expect %s owned by %s, but %s got", k, v, node)
+		}
+	}
+	// virtual nodes 8, 18, 28
+	ring.Add("8")
+	cases["27"] = "8"
+	for k, v := range cases {
+		if node := ring.Get(k); node != v {
+			t.Fatalf("expect %s owned by %s, but %s got", k, v, node)
+		}
+	}
+}
+
+type fakePeers map[string]PeerGetter
+
+func (f fakePeers) PickPeer(key string) (PeerGetter, bool) {
+	peer, ok := f[key]
+	return peer, ok
+}
+
+type fakePeer struct {
+	values map[string]string
+}
+
+func (p fakePeer) Get(group string, key string) ([]byte, error) {
+	if v, ok := p.values[key]; ok {
+		return []byte(v), nil
+	}
+	return nil, errors.New("peer down")
+}
+
+func TestGetFromPeer(t *testing.T) {
+	g := NewGroup("peers", 2<<10, GetterFunc(func(key string) ([]byte, error) { return []byte("local " + key), nil }))
+	peer := fakePeer{values: map[string]string{"remote": "peer remote"}}
+	g.RegisterPeers(fakePeers{"remote": peer, "down": peer})
+
+	cases := map[string]string{"remote": "peer remote", "own": "local own", "down": "local down"}
+	for key, expect := range cases {
+		if v, err := g.Get(key); err != nil || v.String() != expect {
+			t.Fatalf("expect %q for %s, but %q got, error: %v", expect, key, v, err)
+		}
+	}
+	if _, ok := g.mainCache.peek("remote"); ok {
+		t.Fatal("expect values of peers not to be cached")
+	}
+	if v, _ := g.get("remote", false); v.String() != "local remote" {
+		t.Fatal("expect requests from peers not to be routed again")
+	}
+}
+
+func TestHTTPPoolPickPeer(t *testing.T) {
+	var header string
+	owner := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Get(peerHeader)
+		_, _ = w.Write([]byte(r.URL.Path + " " + r.URL.Query().Get("key")))
+	}))
+	defer owner.Close()
+
+	p := NewHTTPPool("http://self", HTTPPoolWithReplicas(10))
+	p.Set("http://self", owner.URL)
+	owned := 0
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("sz%06d", i)
+		peer, ok := p.PickPeer(key)
+		if !ok {
+			owned++
+			continue
+		}
+		b, err := peer.Get(Sina, key)
+		if err != nil || string(b) != defaultBasePath+Sina+" "+key || header == "" {
+			t.Fatalf("unexpected response %q of the owner, error: %v", b, err)
+		}
+	}
+	if owned == 0 || owned == 100 {
+		t.Fatalf("expect keys to be spread over both peers, but self owns %d", owned)
+	}
+}
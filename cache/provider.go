@@ -0,0 +1,210 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const Tencent = "tencent"
+const Eastmoney = "eastmoney"
+
+// Kinds of invalid payloads, see PayloadError.
+var (
+	ErrEmpty     = errors.New("empty")
+	ErrBlocked   = errors.New("blocked")
+	ErrMalformed = errors.New("malformed")
+	// ErrOutOfLimit is a price beyond the daily limit of its exchange
+	ErrOutOfLimit = errors.New("out of limit")
+	// ErrOutdated is a quote older than the cached one
+	ErrOutdated = errors.New("outdated")
+)
+
+// A PayloadError reports an upstream payload that must not be cached, its
+// Kind is one of the errors above.
+type PayloadError struct {
+	Provider string
+	Kind     error
+	Detail   string
+}
+
+func (e *PayloadError) Error() string {
+	return fmt.Sprintf("%s payload from %s: %s", e.Kind.Error(), e.Provider, e.Detail)
+}
+
+func (e *PayloadError) Unwrap() error {
+	return e.Kind
+}
+
+// A Quote is the normalized real-time quote every provider parses into.
+type Quote struct {
+	Symbol    string    `json:"symbol"`
+	Name      string    `json:"name"`
+	Open      float64   `json:"open"`
+	PrevClose float64   `json:"prev_close"`
+	Price     float64   `json:"price"`
+	High      float64   `json:"high"`
+	Low       float64   `json:"low"`
+	Volume    float64   `json:"volume"` // shares
+	Amount    float64   `json:"amount"` // yuan
+	Time      time.Time `json:"time"`
+}
+
+// A Provider fetches and parses quotes from one upstream data source.
+//
+// Symbols passed in and out of a Provider are canonical, e.g. "sh600000",
+// "sz000001" or "bj430047"; each provider maps them to its own codes.
+type Provider interface {
+	// Name returns the provider's name, e.g. "sina"
+	Name() string
+	// Host returns the upstream host requests are sent to
+	Host() string
+	// Symbols maps a cache key to the canonical symbols it covers
+	Symbols(key string) ([]string, error)
+	// Fetch requests the raw payload for the canonical symbols, giving up
+	// once ctx is done
+	Fetch(ctx context.Context, symbols []string, timeout time.Duration) ([]byte, error)
+	// Validate returns a PayloadError if a raw payload is empty or shows
+	// that the provider blocked us
+	Validate(b []byte) error
+	// Parse decodes a raw payload into normalized quotes
+	Parse(b []byte) ([]Quote, error)
+	// Format renders quotes in the provider's own payload format
+	Format(quotes []Quote) []byte
+}
+
+var chinaZone = loadZone("Asia/Shanghai", 8*60*60)
+
+var (
+	providersMu sync.RWMutex
+	providers   = make(map[string]Provider)
+)
+
+// RegisterProvider makes a provider available by name.
+func RegisterProvider(p Provider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[p.Name()] = p
+}
+
+// GetProvider returns the named provider, or nil if there's no such provider.
+func GetProvider(name string) Provider {
+	providersMu.RLock()
+	p := providers[name]
+	providersMu.RUnlock()
+	return p
+}
+
+func init() {
+	RegisterProvider(NewSinaProvider())
+	RegisterProvider(NewTencentProvider())
+	RegisterProvider(NewEastmoneyProvider())
+}
+
+// splitSymbols splits a key into its symbols and checks each of them. Keys
+// are either "sh600000,sz000001" or urls ending in the symbol list, like the
+// legacy "http://hq.sinajs.cn/list=sh600000,sz000001".
+func splitSymbols(s string) ([]string, error) {
+	if i := strings.LastIndex(s, "="); i >= 0 {
+		s = s[i+1:]
+	}
+	symbols := make([]string, 0)
+	for _, symbol := range strings.Split(s, ",") {
+		symbol = strings.ToLower(strings.TrimSpace(symbol))
+		if symbol == "" {
+			continue
+		}
+		if _, _, err := splitSymbol(symbol); err != nil {
+			return nil, err
+		}
+		symbols = append(symbols, symbol)
+	}
+	if len(symbols) == 0 {
+		return nil, fmt.Errorf("no symbol in %q", s)
+	}
+	return symbols, nil
+}
+
+// splitSymbol splits a canonical symbol into its exchange and code.
+func splitSymbol(symbol string) (exchange, code string, err error) {
+	if len(symbol) != 8 {
+		return "", "", fmt.Errorf("invalid symbol: %s", symbol)
+	}
+	exchange, code = symbol[:2], symbol[2:]
+	switch exchange {
+	case "sh", "sz", "bj":
+	default:
+		return "", "", fmt.Errorf("unsupported exchange: %s", symbol)
+	}
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return "", "", fmt.Errorf("invalid symbol: %s", symbol)
+		}
+	}
+	return
+}
+
+// httpProvider holds what providers of an http api have in common.
+type httpProvider struct {
+	api     string
+	headers map[string]string
+	// charset of payloads whose Content-Type doesn't declare one
+	charset string
+}
+
+// Host implements Provider
+func (p *httpProvider) Host() string {
+	return hostOf(p.api)
+}
+
+// SetCharset sets the charset of payloads whose Content-Type doesn't
+// declare one.
+func (p *httpProvider) SetCharset(charset string) {
+	p.charset = charset
+}
+
+// get requests the api with query appended, until ctx is done.
+func (p *httpProvider) get(ctx context.Context, query string, timeout time.Duration) ([]byte, error) {
+	return fetch(ctx, p.api+query, p.headers, p.charset, timeout)
+}
+
+// validatePayload classifies payloads every provider rejects: blank ones, and
+// HTML error or captcha pages served with status 200 when we are blocked.
+func validatePayload(provider string, b []byte) error {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return &PayloadError{Provider: provider, Kind: ErrEmpty, Detail: "blank body"}
+	}
+	if blockedPage(b) {
+		return &PayloadError{Provider: provider, Kind: ErrBlocked, Detail: fmt.Sprintf("%.64s", b)}
+	}
+	return nil
+}
+
+// blockedPage reports whether trimmed payload b is an HTML error or captcha
+// page rather than data.
+func blockedPage(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	head := b
+	if len(head) > 512 {
+		head = head[:512]
+	}
+	lower := bytes.ToLower(head)
+	return b[0] == '<' || bytes.Contains(lower, []byte("<html")) || bytes.Contains(lower, []byte("forbidden"))
+}
+
+// loadZone loads the named location, falling back to a fixed offset when the
+// system has no tz database.
+func loadZone(name string, offset int) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return time.FixedZone(name, offset)
+	}
+	return loc
+}
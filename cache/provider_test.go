@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var testQuote = Quote{
+	Symbol:    "sz000001",
+	Name:      "平安银行",
+	Open:      17.5,
+	PrevClose: 17.4,
+	Price:     17.8,
+	High:      17.9,
+	Low:       17.3,
+	Volume:    123456700,
+	Amount:    2198765432,
+	Time:      time.Date(2021, 8, 20, 15, 0, 3, 0, chinaZone),
+}
+
+func TestProviderSymbols(t *testing.T) {
+	for _, name := range []string{Sina, Tencent, Eastmoney} {
+		p := GetProvider(name)
+		symbols, err := p.Symbols("http://hq.sinajs.cn/list=sz000001,sh600000")
+		if err != nil || !reflect.DeepEqual(symbols, []string{"sz000001", "sh600000"}) {
+			t.Fatalf("%s: unexpected symbols %v, error: %v", name, symbols, err)
+		}
+		if _, err := p.Symbols("list=xx000001"); err == nil {
+			t.Fatalf("%s: expect error for unsupported exchange", name)
+		}
+	}
+
+	symbols, _ := GetProvider(Eastmoney).Symbols("1.600000,0.000001,0.430047")
+	if !reflect.DeepEqual(symbols, []string{"sh600000", "sz000001", "bj430047"}) {
+		t.Fatalf("unexpected eastmoney symbols %v", symbols)
+	}
+}
+
+func TestProviderParse(t *testing.T) {
+	payloads := map[string]string{
+		Sina: `var hq_str_sz000001="平安银行,17.500,17.400,17.800,17.900,17.300,17.790,17.800,123456700,2198765432.000,` +
+			`1,17.790,2,17.780,3,17.770,4,17.760,5,17.750,1,17.800,2,17.810,3,17.820,4,17.830,5,17.840,2021-08-20,15:00:03,00";`,
+		Tencent: `v_sz000001="51~平安银行~000001~17.80~17.40~17.50~1234567~0~0~17.79~1~0~0~0~0~0~0~0~0~17.80~1~0~0~0~0~0~0~0~0~` +
+			`~20210820150003~0.40~2.30~17.90~17.30~17.80/1234567/2198765432~1234567~219876.5432~0.60";`,
+		Eastmoney: `{"rc":0,"data":{"total":1,"diff":[{"f2":17.8,"f5":1234567,"f6":2198765432,"f12":"000001","f13":0,` +
+			`"f14":"平安银行","f15":17.9,"f16":17.3,"f17":17.5,"f18":17.4,"f124":1629442803}]}}`,
+	}
+	for name, payload := range payloads {
+		p := GetProvider(name)
+		quotes, err := p.Parse([]byte(payload))
+		if err != nil {
+			t.Fatalf("%s: parse failed, error: %s", name, err.Error())
+		}
+		if len(quotes) != 1 || !quoteEqual(quotes[0], testQuote) {
+			t.Fatalf("%s: expect %+v, but %+v got", name, testQuote, quotes)
+		}
+	}
+}
+
+func TestProviderFormat(t *testing.T) {
+	for _, name := range []string{Sina, Tencent, Eastmoney} {
+		p := GetProvider(name)
+		quotes, err := p.Parse(p.Format([]Quote{testQuote}))
+		if err != nil || len(quotes) != 1 || !quoteEqual(quotes[0], testQuote) {
+			t.Fatalf("%s: format round trip failed, got %+v, error: %v", name, quotes, err)
+		}
+	}
+}
+
+func quoteEqual(a, b Quote) bool {
+	return a.Time.Equal(b.Time) && a.Symbol == b.Symbol && a.Name == b.Name && a.Open == b.Open &&
+		a.PrevClose == b.PrevClose && a.Price == b.Price && a.High == b.High && a.Low == b.Low &&
+		a.Volume == b.Volume && a.Amount == b.Amount
+}
+
+func TestProviderValidate(t *testing.T) {
+	cases := []struct {
+		provider string
+		payload  string
+		kind     error
+	}{
+		{Sina, "", ErrEmpty},
+		{Sina, `var hq_str_sz000001="";`, ErrEmpty},
+		{Sina, "<html><body>Forbidden</body></html>", ErrBlocked},
+		{Sina, `var hq_str_sz000001="平安银行,17.500";`, ErrMalformed},
+		{Sina, `hq_str_sz000001`, ErrMalformed},
+		{Tencent, `v_pv_none_match="1";`, ErrEmpty},
+		{Tencent, "<!DOCTYPE html><title>403</title>", ErrBlocked},
+		{Eastmoney, `{"rc":0,"data":null}`, ErrEmpty},
+		{Eastmoney, `{"rc":0,"data":`, ErrMalformed},
+	}
+	for _, c := range cases {
+		p := GetProvider(c.provider)
+		_, err := validate(p, []string{"sz000001"}, []byte(c.payload))
+		if !errors.Is(err, c.kind) {
+			t.Fatalf("%s: expect %s for %q, but %v got", c.provider, c.kind, c.payload, err)
+		}
+	}
+}
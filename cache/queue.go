@@ -0,0 +1,740 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"stock_data_cache/utils"
+	"sync"
+	"time"
+)
+
+// A Priority is the class of a queued key, lower values are leased first.
+type Priority int
+
+const (
+	// PriorityMiss is a key that isn't cached, a client got an error for it
+	PriorityMiss Priority = iota
+	// PriorityStale is an expired key a client just read
+	PriorityStale
+	// PriorityBackground is an expired key found by SendTimeoutCache
+	PriorityBackground
+	numPriorities
+)
+
+var priorityNames = [numPriorities]string{"miss", "stale", "background"}
+
+func (p Priority) String() string {
+	if p < 0 || p >= numPriorities {
+		return fmt.Sprintf("priority(%d)", int(p))
+	}
+	return priorityNames[p]
+}
+
+// QueueConfig configures a group's queue of keys waiting to be refreshed.
+type QueueConfig struct {
+	// Capacity is the maximum number of queued keys, leased ones included
+	Capacity int
+	// Visibility is how long a leased key stays invisible before it is
+	// queued again unless the lease is acknowledged
+	Visibility time.Duration
+	// MaxAttempts is the number of leases after which a key that was never
+	// acknowledged is moved to the dead letters
+	MaxAttempts int
+	// StaleWeight and BackgroundWeight share the leases between stale and
+	// background keys while there is no miss, misses always go first
+	StaleWeight      int
+	BackgroundWeight int
+	// Retry delays the keys workers reported failures for, see Nack, and
+	// quarantines a key after Retry.Attempts failures in a row that were
+	// the key's own fault, see keyFailure
+	Retry utils.RetryPolicy
+	// Quarantine is how long a quarantined key isn't queued again
+	Quarantine time.Duration
+	// MaxFailures is the number of failures in a row, whatever their class,
+	// after which a key is moved to the dead letters, so that a key the
+	// upstream keeps failing on isn't retried forever
+	MaxFailures int
+	// SyncInterval is how long changes logged to the queue's file may wait
+	// to be synced to disk, the ones a machine crash may lose: 0 syncs each
+	// change, a negative interval leaves it to the OS, see Open
+	SyncInterval time.Duration
+}
+
+var DefaultQueueConfig = QueueConfig{
+	Capacity:         MissedChanLen,
+	Visibility:       time.Second * 30,
+	MaxAttempts:      5,
+	StaleWeight:      4,
+	BackgroundWeight: 1,
+	Retry: utils.RetryPolicy{
+		Attempts:  5,
+		BaseDelay: time.Second * 2,
+		MaxDelay:  time.Minute * 2,
+		Jitter:    0.2,
+	},
+	Quarantine:   time.Minute * 30,
+	MaxFailures:  20,
+	SyncInterval: time.Second,
+}
+
+var (
+	// ErrQueueFull is a key not queued because the queue is at capacity
+	ErrQueueFull = errors.New("queue full")
+	// ErrQuarantined is a key not queued because it is quarantined
+	ErrQuarantined = errors.New("key quarantined")
+)
+
+// maxDeadLetters bounds the dead letters kept, the oldest are dropped first.
+const maxDeadLetters = 1000
+
+// A Lease hands a queued key to one worker until its deadline. Owner is the
+// worker's slave ID, if it has one.
+type Lease struct {
+	Key      string    `json:"key"`
+	Token    string    `json:"token"`
+	Owner    string    `json:"owner,omitempty"`
+	Priority Priority  `json:"priority"`
+	Attempts int       `json:"attempts"`
+	Leased   time.Time `json:"leased"`
+	Deadline time.Time `json:"deadline"`
+}
+
+// A DeadLetter is a key given up on after too many unacknowledged leases or
+// failures reported.
+type DeadLetter struct {
+	Key      string    `json:"key"`
+	Attempts int       `json:"attempts"`
+	Failures int       `json:"failures,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// A Failure is a worker's report that it couldn't refresh a key, Class is
+// one of the Failure classes, see classify.
+type Failure struct {
+	Class   string    `json:"class"`
+	Message string    `json:"message"`
+	Slave   string    `json:"slave,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+// A QuarantinedKey is a key that failed too many times in a row, it isn't
+// queued until Until.
+type QuarantinedKey struct {
+	Key         string    `json:"key"`
+	Failures    int       `json:"failures"`
+	Until       time.Time `json:"until"`
+	LastFailure Failure   `json:"last_failure"`
+}
+
+// QueueStats is a snapshot of a WorkQueue. Deduplicated counts enqueues of
+// keys already queued, Dropped the keys rejected or evicted because it was
+// full.
+// Delayed keys wait to be retried after failures.
+type QueueStats struct {
+	Ready        int              `json:"ready"`
+	Priorities   map[string]int   `json:"priorities"`
+	Leased       int              `json:"leased"`
+	Delayed      int              `json:"delayed"`
+	Deduplicated int64            `json:"deduplicated"`
+	Dropped      int64            `json:"dropped"`
+	DeadLetters  []DeadLetter     `json:"dead_letters"`
+	Quarantined  []QuarantinedKey `json:"quarantined"`
+}
+
+// KeyState is where a key is in a WorkQueue: one of the Key states.
+type KeyState struct {
+	State       string     `json:"state"`
+	Priority    string     `json:"priority,omitempty"`
+	Attempts    int        `json:"attempts,omitempty"`
+	Failures    int        `json:"failures,omitempty"`
+	LastFailure *Failure   `json:"last_failure,omitempty"`
+	NotBefore   *time.Time `json:"not_before,omitempty"`
+}
+
+// Key states, see KeyState.
+const (
+	KeyIdle        = "idle"
+	KeyReady       = "ready"
+	KeyLeased      = "leased"
+	KeyDelayed     = "delayed"
+	KeyQuarantined = "quarantined"
+	KeyDead        = "dead"
+)
+
+type queueItem struct {
+	key      string
+	priority Priority
+	attempts int
+	// failures counts the failures reported in a row, keyFailures the ones
+	// of them that were the key's own fault, see Nack
+	failures    int
+	keyFailures int
+	lastFailure *Failure
+	// notBefore is when a delayed item is ready again
+	notBefore time.Time
+	// ele is the item's element in its ready list, nil while leased or
+	// delayed
+	ele *list.Element
+}
+
+// WorkQueue is a queue of keys to refresh where a dequeued key is leased: it
+// is invisible until the lease's deadline and is queued again unless the
+// lease is acknowledged by then. Each key is queued at most once, leased or
+// not, and keys are leased by priority, see QueueConfig. It is safe for
+// concurrent access.
+type WorkQueue struct {
+	mu     sync.Mutex
+	config QueueConfig
+	ready  [numPriorities]*list.List
+	// current is the state of the smooth weighted round robin between stale
+	// and background keys
+	current      [numPriorities]int
+	queued       map[string]*queueItem
+	leases       map[string]*Lease
+	items        map[string]*queueItem // leased items by lease token
+	delayed      []*queueItem          // by notBefore
+	quarantined  map[string]*QuarantinedKey
+	dead         []DeadLetter
+	deduplicated int64
+	dropped      int64
+	// onExpired is called with each lease that expired, with mu held
+	onExpired func(Lease)
+	// log keeps the queued keys across restarts once opened, see Open
+	log *queueLog
+	// compacting is set while persist compacts log in the background
+	compacting bool
+}
+
+// NewWorkQueue create a new instance of WorkQueue
+func NewWorkQueue(config QueueConfig) *WorkQueue {
+	q := &WorkQueue{
+		config:      config,
+		queued:      make(map[string]*queueItem),
+		leases:      make(map[string]*Lease),
+		items:       make(map[string]*queueItem),
+		quarantined: make(map[string]*QuarantinedKey),
+	}
+	for i := range q.ready {
+		q.ready[i] = list.New()
+	}
+	return q
+}
+
+// Enqueue queues key with priority unless it is queued already, in which
+// case a waiting key is raised to priority if that is higher. A miss queued
+// while the queue is full evicts the waiting background or stale key queued
+// first, a client is waiting for it. It fails with
+// ErrQueueFull if the queue is full, and with ErrQuarantined if key is
+// quarantined.
+func (q *WorkQueue) Enqueue(key string, priority Priority) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	changed, err := q.enqueue(key, priority)
+	if changed {
+		q.persist(queueOpAdd, key, priority)
+	}
+	return err
+}
+
+// enqueue implements Enqueue with q.mu held, changed reports whether key was
+// queued or raised.
+func (q *WorkQueue) enqueue(key string, priority Priority) (changed bool, err error) {
+	if quarantined, ok := q.quarantined[key]; ok {
+		if time.Now().Before(quarantined.Until) {
+			return false, ErrQuarantined
+		}
+		delete(q.quarantined, key)
+	}
+	if item, ok := q.queued[key]; ok {
+		q.deduplicated++
+		if item.ele != nil && priority < item.priority {
+			q.ready[item.priority].Remove(item.ele)
+			item.priority = priority
+			item.ele = q.ready[priority].PushBack(item)
+			return true, nil
+		}
+		return false, nil
+	}
+	if len(q.queued) >= q.config.Capacity && (priority != PriorityMiss || !q.evict()) {
+		q.dropped++
+		return false, ErrQueueFull
+	}
+	item := &queueItem{key: key, priority: priority}
+	item.ele = q.ready[priority].PushBack(item)
+	q.queued[key] = item
+	return true, nil
+}
+
+// evict drops the waiting background key queued first, or else the stale
+// one, with q.mu held. It returns false if there is none.
+func (q *WorkQueue) evict() bool {
+	for _, p := range []Priority{PriorityBackground, PriorityStale} {
+		ele := q.ready[p].Front()
+		if ele == nil {
+			continue
+		}
+		item := ele.Value.(*queueItem)
+		q.ready[p].Remove(ele)
+		delete(q.queued, item.key)
+		q.dropped++
+		q.persist(queueOpDone, item.key, item.priority)
+		fmt.Printf("queued key evicted for a miss, key: %s, priority: %s\n", item.key, p)
+		return true
+	}
+	return false
+}
+
+// Lease dequeues the next visible key for owner, it returns false if there
+// is none.
+func (q *WorkQueue) Lease(owner string) (Lease, bool) {
+	return q.LeaseIf(owner, nil)
+}
+
+// LeaseIf is Lease that leaves the next visible key queued unless fits
+// accepts it, e.g. because it would make a batch too large.
+func (q *WorkQueue) LeaseIf(owner string, fits func(key string) bool) (Lease, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.reclaim(time.Now())
+
+	current := q.current
+	priority, ok := q.next()
+	if !ok {
+		return Lease{}, false
+	}
+	ele := q.ready[priority].Front()
+	item := ele.Value.(*queueItem)
+	if fits != nil && !fits(item.key) {
+		// the class keeps its turn
+		q.current = current
+		return Lease{}, false
+	}
+	q.ready[priority].Remove(ele)
+	item.ele = nil
+	item.attempts++
+	now := time.Now()
+	lease := &Lease{
+		Key:      item.key,
+		Token:    newLeaseToken(),
+		Owner:    owner,
+		Priority: item.priority,
+		Attempts: item.attempts,
+		Leased:   now,
+		Deadline: now.Add(q.config.Visibility),
+	}
+	q.leases[lease.Token] = lease
+	q.items[lease.Token] = item
+	return *lease, true
+}
+
+// next picks the class of the next lease: misses first, then stale and
+// background keys by smooth weighted round robin.
+func (q *WorkQueue) next() (Priority, bool) {
+	if q.ready[PriorityMiss].Len() > 0 {
+		return PriorityMiss, true
+	}
+	weights := [numPriorities]int{0, q.config.StaleWeight, q.config.BackgroundWeight}
+	best, total := Priority(-1), 0
+	for p := PriorityStale; p < numPriorities; p++ {
+		if q.ready[p].Len() == 0 {
+			continue
+		}
+		// a class without weight still gets its turn, it must not starve
+		if weights[p] <= 0 {
+			weights[p] = 1
+		}
+		q.current[p] += weights[p]
+		total += weights[p]
+		if best < 0 || q.current[p] > q.current[best] {
+			best = p
+		}
+	}
+	if best < 0 {
+		return 0, false
+	}
+	q.current[best] -= total
+	return best, true
+}
+
+// Ack acknowledges the lease with token, removing its key from the queue.
+// It returns false if the lease is unknown, e.g. because it expired.
+func (q *WorkQueue) Ack(token string) (Lease, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.reclaim(time.Now())
+	lease, ok := q.leases[token]
+	if !ok {
+		return Lease{}, false
+	}
+	delete(q.leases, token)
+	delete(q.items, token)
+	delete(q.queued, lease.Key)
+	q.persist(queueOpDone, lease.Key, lease.Priority)
+	return *lease, true
+}
+
+// AckKey acknowledges every lease of key, for workers that don't send back
+// their lease token, and removes key from the queue if it is delayed after
+// a failure. It returns the leases acknowledged.
+func (q *WorkQueue) AckKey(key string) []Lease {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.reclaim(time.Now())
+	acked := make([]Lease, 0)
+	for token, lease := range q.leases {
+		if lease.Key == key {
+			delete(q.leases, token)
+			delete(q.items, token)
+			delete(q.queued, key)
+			acked = append(acked, *lease)
+			q.persist(queueOpDone, key, lease.Priority)
+		}
+	}
+	for i, item := range q.delayed {
+		if item.key == key {
+			q.delayed = append(q.delayed[:i], q.delayed[i+1:]...)
+			delete(q.queued, key)
+			q.persist(queueOpDone, key, item.priority)
+			break
+		}
+	}
+	return acked
+}
+
+// Nack ends the lease with token for a key its worker failed to refresh: the
+// key is retried after a backoff growing with the failures in a row, and is
+// quarantined once the ones that were its own fault reach the retry
+// attempts, see QueueConfig. Failures of the upstream, e.g. timeouts, only
+// delay it until the failures in a row reach MaxFailures, then it is moved
+// to the dead letters. Reported failures don't count as attempts. It returns
+// false if the lease is unknown, e.g. because it expired.
+func (q *WorkQueue) Nack(token string, failure Failure) (Lease, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	q.reclaim(now)
+	lease, ok := q.leases[token]
+	if !ok {
+		return Lease{}, false
+	}
+	item := q.items[token]
+	delete(q.leases, token)
+	delete(q.items, token)
+	if failure.Time.IsZero() {
+		failure.Time = now
+	}
+	item.attempts--
+	item.failures++
+	if keyFailure(failure.Class) {
+		item.keyFailures++
+	}
+	item.lastFailure = &failure
+
+	if q.config.Retry.Attempts > 0 && item.keyFailures >= q.config.Retry.Attempts {
+		fmt.Printf("key quarantined, key: %s, failures: %d, error: %s\n", item.key, item.failures, failure.Message)
+		delete(q.queued, item.key)
+		q.quarantined[item.key] = &QuarantinedKey{
+			Key:         item.key,
+			Failures:    item.failures,
+			Until:       now.Add(q.config.Quarantine),
+			LastFailure: failure,
+		}
+		q.persist(queueOpDone, item.key, item.priority)
+		return *lease, true
+	}
+	if q.config.MaxFailures > 0 && item.failures >= q.config.MaxFailures {
+		fmt.Printf("key dead, key: %s, failures: %d, error: %s\n", item.key, item.failures, failure.Message)
+		q.bury(item, now)
+		return *lease, true
+	}
+	item.notBefore = now.Add(q.config.Retry.Backoff(item.failures))
+	i := sort.Search(len(q.delayed), func(i int) bool { return q.delayed[i].notBefore.After(item.notBefore) })
+	q.delayed = append(q.delayed, nil)
+	copy(q.delayed[i+1:], q.delayed[i:])
+	q.delayed[i] = item
+	return *lease, true
+}
+
+// State returns where key is in the queue, with the failures reported for it.
+func (q *WorkQueue) State(key string) KeyState {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	now := time.Now()
+	q.reclaim(now)
+	if quarantined, ok := q.quarantined[key]; ok && now.Before(quarantined.Until) {
+		failure := quarantined.LastFailure
+		until := quarantined.Until
+		return KeyState{State: KeyQuarantined, Failures: quarantined.Failures, LastFailure: &failure, NotBefore: &until}
+	}
+	item, ok := q.queued[key]
+	if !ok {
+		for i := len(q.dead) - 1; i >= 0; i-- {
+			if q.dead[i].Key == key {
+				return KeyState{State: KeyDead, Attempts: q.dead[i].Attempts, Failures: q.dead[i].Failures}
+			}
+		}
+		return KeyState{State: KeyIdle}
+	}
+	state := KeyState{
+		State:       KeyReady,
+		Priority:    item.priority.String(),
+		Attempts:    item.attempts,
+		Failures:    item.failures,
+		LastFailure: item.lastFailure,
+	}
+	switch {
+	case item.ele != nil:
+	case !item.notBefore.IsZero():
+		state.State = KeyDelayed
+		notBefore := item.notBefore
+		state.NotBefore = &notBefore
+	default:
+		state.State = KeyLeased
+	}
+	return state
+}
+
+// Release queues the keys leased by owner again at once, e.g. because the
+// owner died. The leases don't count as attempts. It returns the number of
+// keys released.
+func (q *WorkQueue) Release(owner string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for token, lease := range q.leases {
+		if lease.Owner == owner {
+			q.release(token)
+			n++
+		}
+	}
+	return n
+}
+
+// ReleaseLease queues the key leased with token again at once, like
+// Release, e.g. because the stream it was leased on closed while its owner
+// may hold other leases. It returns false if the lease is unknown.
+func (q *WorkQueue) ReleaseLease(token string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.leases[token]; !ok {
+		return false
+	}
+	q.release(token)
+	return true
+}
+
+// release ends the lease with token without counting it as an attempt, with
+// q.mu held.
+func (q *WorkQueue) release(token string) {
+	item := q.items[token]
+	delete(q.leases, token)
+	delete(q.items, token)
+	item.attempts--
+	item.ele = q.ready[item.priority].PushFront(item)
+}
+
+// Leased reports whether the lease with token is still held, it is not once
+// acknowledged or expired.
+func (q *WorkQueue) Leased(token string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.reclaim(time.Now())
+	_, ok := q.leases[token]
+	return ok
+}
+
+// Len returns the number of queued keys, leased ones included.
+func (q *WorkQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.queued)
+}
+
+// Stats returns a snapshot of the queue.
+func (q *WorkQueue) Stats() QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.reclaim(time.Now())
+	stats := QueueStats{
+		Priorities:   make(map[string]int),
+		Leased:       len(q.leases),
+		Delayed:      len(q.delayed),
+		Deduplicated: q.deduplicated,
+		Dropped:      q.dropped,
+		DeadLetters:  make([]DeadLetter, len(q.dead)),
+	}
+	for p, l := range q.ready {
+		stats.Ready += l.Len()
+		stats.Priorities[Priority(p).String()] = l.Len()
+	}
+	copy(stats.DeadLetters, q.dead)
+	stats.Quarantined = make([]QuarantinedKey, 0, len(q.quarantined))
+	for _, quarantined := range q.quarantined {
+		stats.Quarantined = append(stats.Quarantined, *quarantined)
+	}
+	sort.Slice(stats.Quarantined, func(i, j int) bool { return stats.Quarantined[i].Until.Before(stats.Quarantined[j].Until) })
+	return stats
+}
+
+// reclaim queues the keys of leases expired at now again, or moves them to
+// the dead letters once they ran out of attempts. Delayed keys due by now
+// are queued again, and quarantines over by now are lifted.
+func (q *WorkQueue) reclaim(now time.Time) {
+	due := 0
+	for due < len(q.delayed) && !now.Before(q.delayed[due].notBefore) {
+		due++
+	}
+	// latest first, so that the keys delayed first end up in front
+	for i := due - 1; i >= 0; i-- {
+		item := q.delayed[i]
+		item.notBefore = time.Time{}
+		item.ele = q.ready[item.priority].PushFront(item)
+	}
+	q.delayed = q.delayed[due:]
+	for key, quarantined := range q.quarantined {
+		if !now.Before(quarantined.Until) {
+			delete(q.quarantined, key)
+		}
+	}
+
+	expired := make([]*Lease, 0)
+	for _, lease := range q.leases {
+		if !now.Before(lease.Deadline) {
+			expired = append(expired, lease)
+		}
+	}
+	// latest deadline first, so that the keys leased first end up in front
+	sort.Slice(expired, func(i, j int) bool { return expired[i].Deadline.After(expired[j].Deadline) })
+	for _, lease := range expired {
+		item := q.items[lease.Token]
+		delete(q.leases, lease.Token)
+		delete(q.items, lease.Token)
+		if q.onExpired != nil {
+			q.onExpired(*lease)
+		}
+		if item.attempts >= q.config.MaxAttempts {
+			fmt.Printf("lease dead, key: %s, attempts: %d\n", item.key, item.attempts)
+			q.bury(item, now)
+			continue
+		}
+		// retried keys go first in their class, they have been waiting the longest
+		item.ele = q.ready[item.priority].PushFront(item)
+	}
+}
+
+// bury moves a key out of the queue to the dead letters, with q.mu held.
+func (q *WorkQueue) bury(item *queueItem, now time.Time) {
+	delete(q.queued, item.key)
+	q.persist(queueOpDone, item.key, item.priority)
+	q.dead = append(q.dead, DeadLetter{Key: item.key, Attempts: item.attempts, Failures: item.failures, Time: now})
+	if len(q.dead) > maxDeadLetters {
+		q.dead = q.dead[len(q.dead)-maxDeadLetters:]
+	}
+}
+
+// Open replays the changes logged to the file at path, queueing the keys it
+// holds again, then compacts it and logs the queue's changes to it so that
+// queued keys survive restarts. Leases don't survive, their keys are queued
+// again.
+func (q *WorkQueue) Open(path string) error {
+	q.mu.Lock()
+	records, err := readQueueLog(path)
+	if err != nil && !os.IsNotExist(err) {
+		q.mu.Unlock()
+		return err
+	}
+	for _, r := range records {
+		switch r.Op {
+		case queueOpAdd:
+			q.enqueue(r.Key, r.Priority)
+		case queueOpDone:
+			q.forget(r.Key)
+		}
+	}
+	q.deduplicated, q.dropped = 0, 0
+	log := &queueLog{path: path, syncInterval: q.config.SyncInterval}
+	log.beginRewrite()
+	q.log = log
+	records = q.records()
+	q.mu.Unlock()
+	return log.rewrite(records)
+}
+
+// Compact rewrites the queue's file with just the keys queued now, it does
+// nothing unless the queue was opened or while it is compacted already. The
+// file is written without holding the queue, changes made meanwhile are
+// logged after the keys.
+func (q *WorkQueue) Compact() error {
+	q.mu.Lock()
+	if q.log == nil || !q.log.beginRewrite() {
+		q.mu.Unlock()
+		return nil
+	}
+	records := q.records()
+	log := q.log
+	q.mu.Unlock()
+	return log.rewrite(records)
+}
+
+// records returns the records of the keys queued, with q.mu held. Leased and
+// delayed keys go first since they have been waiting the longest.
+func (q *WorkQueue) records() []queueRecord {
+	records := make([]queueRecord, 0, len(q.queued))
+	for _, item := range q.items {
+		records = append(records, queueRecord{Op: queueOpAdd, Key: item.key, Priority: item.priority})
+	}
+	for _, item := range q.delayed {
+		records = append(records, queueRecord{Op: queueOpAdd, Key: item.key, Priority: item.priority})
+	}
+	for _, l := range q.ready {
+		for ele := l.Front(); ele != nil; ele = ele.Next() {
+			item := ele.Value.(*queueItem)
+			records = append(records, queueRecord{Op: queueOpAdd, Key: item.key, Priority: item.priority})
+		}
+	}
+	return records
+}
+
+// forget removes a waiting key from the queue while replaying its file.
+func (q *WorkQueue) forget(key string) {
+	item, ok := q.queued[key]
+	if !ok {
+		return
+	}
+	if item.ele != nil {
+		q.ready[item.priority].Remove(item.ele)
+	}
+	delete(q.queued, key)
+}
+
+// persist logs a change to the queue's file, if it was opened, and compacts
+// the file in the background once it is bloated, one compaction at a time.
+func (q *WorkQueue) persist(op, key string, priority Priority) {
+	if q.log == nil {
+		return
+	}
+	q.log.append(queueRecord{Op: op, Key: key, Priority: priority})
+	if q.compacting || !q.log.bloated(len(q.queued)) {
+		return
+	}
+	q.compacting = true
+	go func() {
+		if err := q.Compact(); err != nil {
+			fmt.Printf("compact queue failed, error: %s\n", err.Error())
+		}
+		q.mu.Lock()
+		q.compacting = false
+		q.mu.Unlock()
+	}()
+}
+
+func newLeaseToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
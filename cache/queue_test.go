@@ -0,0 +1,360 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"stock_data_cache/utils"
+	"testing"
+	"time"
+)
+
+func TestWorkQueueLease(t *testing.T) {
+	q := NewWorkQueue(QueueConfig{Capacity: 2, Visibility: time.Millisecond * 20, MaxAttempts: 2})
+	if q.Enqueue("a", PriorityMiss) != nil || q.Enqueue("b", PriorityMiss) != nil || q.Enqueue("c", PriorityMiss) == nil {
+		t.Fatal("expect enqueue to fail only beyond capacity")
+	}
+
+	a, ok := q.Lease("")
+	if !ok || a.Key != "a" || a.Attempts != 1 {
+		t.Fatalf("unexpected lease %+v", a)
+	}
+	if b, _ := q.Lease(""); b.Key != "b" {
+		t.Fatalf("expect leased keys to be invisible, but %q got", b.Key)
+	}
+	if _, ok := q.Lease(""); ok {
+		t.Fatal("expect no visible key")
+	}
+	if q.Enqueue("c", PriorityMiss) == nil {
+		t.Fatal("expect leased keys to count against capacity")
+	}
+
+	time.Sleep(time.Millisecond * 30)
+	if _, ok := q.Ack(a.Token); ok {
+		t.Fatal("expect expired lease not to be acknowledged")
+	}
+	retried, ok := q.Lease("")
+	if !ok || retried.Key != "a" || retried.Attempts != 2 || retried.Token == a.Token {
+		t.Fatalf("expect expired lease to be leased again, but %+v got", retried)
+	}
+	if _, ok := q.Ack(retried.Token); !ok {
+		t.Fatal("expect lease to be acknowledged")
+	}
+	if _, ok := q.Ack(retried.Token); ok {
+		t.Fatal("expect a lease to be acknowledged once")
+	}
+
+	// b runs out of attempts
+	if b, _ := q.Lease(""); b.Key != "b" || b.Attempts != 2 {
+		t.Fatalf("expect b leased again, but %+v got", b)
+	}
+	time.Sleep(time.Millisecond * 30)
+	stats := q.Stats()
+	if stats.Ready != 0 || stats.Leased != 0 || len(stats.DeadLetters) != 1 || stats.DeadLetters[0].Key != "b" {
+		t.Fatalf("expect b in dead letters, but %+v got", stats)
+	}
+}
+
+func TestWorkQueueEvict(t *testing.T) {
+	q := NewWorkQueue(QueueConfig{Capacity: 3, Visibility: time.Minute, MaxAttempts: 1})
+	q.Enqueue("s", PriorityStale)
+	q.Enqueue("b1", PriorityBackground)
+	q.Enqueue("b2", PriorityBackground)
+	if err := q.Enqueue("b3", PriorityBackground); err != ErrQueueFull {
+		t.Fatalf("expect background keys not to evict, but %v got", err)
+	}
+	for _, key := range []string{"m1", "m2", "m3"} {
+		if err := q.Enqueue(key, PriorityMiss); err != nil {
+			t.Fatalf("expect a miss to evict a waiting key, but %v got", err)
+		}
+	}
+	// b1 and b2 went first, then s
+	for _, key := range []string{"s", "b1", "b2"} {
+		if state := q.State(key); state.State != KeyIdle {
+			t.Fatalf("expect %s evicted, but %+v got", key, state)
+		}
+	}
+	if err := q.Enqueue("m4", PriorityMiss); err != ErrQueueFull {
+		t.Fatalf("expect misses not to evict each other, but %v got", err)
+	}
+	if stats := q.Stats(); stats.Dropped != 5 || stats.Priorities["miss"] != 3 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestWorkQueueDedup(t *testing.T) {
+	q := NewWorkQueue(QueueConfig{Capacity: 2, Visibility: time.Minute, MaxAttempts: 1})
+	for i := 0; i < 1000; i++ {
+		q.Enqueue("hot", PriorityMiss)
+	}
+	if q.Len() != 1 {
+		t.Fatalf("expect a key to be queued once, but %d queued", q.Len())
+	}
+	lease, _ := q.Lease("")
+	if q.Enqueue("hot", PriorityMiss) != nil || q.Len() != 1 {
+		t.Fatal("expect leased keys not to be queued again")
+	}
+	q.Enqueue("a", PriorityMiss)
+	if q.Enqueue("b", PriorityMiss) == nil {
+		t.Fatal("expect enqueue to fail when full")
+	}
+	q.Ack(lease.Token)
+	if q.Enqueue("hot", PriorityMiss) != nil {
+		t.Fatal("expect acknowledged keys to be queued again")
+	}
+	if stats := q.Stats(); stats.Deduplicated != 1000 || stats.Dropped != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestWorkQueuePriority(t *testing.T) {
+	q := NewWorkQueue(QueueConfig{Capacity: 100, Visibility: time.Minute, MaxAttempts: 1, StaleWeight: 4, BackgroundWeight: 1})
+	for i := 0; i < 10; i++ {
+		q.Enqueue(fmt.Sprintf("b%d", i), PriorityBackground)
+		q.Enqueue(fmt.Sprintf("s%d", i), PriorityStale)
+	}
+	q.Enqueue("m", PriorityMiss)
+	q.Enqueue("b9", PriorityMiss) // a client missed a background key
+
+	leased := make([]string, 0)
+	for i := 0; i < 12; i++ {
+		lease, _ := q.Lease("")
+		leased = append(leased, lease.Key)
+	}
+	expect := []string{"m", "b9", "s0", "s1", "b0", "s2", "s3", "s4", "s5", "b1", "s6", "s7"}
+	if !reflect.DeepEqual(leased, expect) {
+		t.Fatalf("expect leases %v, but %v got", expect, leased)
+	}
+	// misses always go first
+	q.Enqueue("m2", PriorityMiss)
+	if lease, _ := q.Lease(""); lease.Key != "m2" || lease.Priority != PriorityMiss {
+		t.Fatalf("expect the miss leased first, but %+v got", lease)
+	}
+}
+
+func TestWorkQueueOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.log")
+	config := QueueConfig{Capacity: 10, Visibility: time.Minute, MaxAttempts: 5, StaleWeight: 1, BackgroundWeight: 1}
+	q := NewWorkQueue(config)
+	if err := q.Open(path); err != nil {
+		t.Fatalf("open failed, error: %s", err.Error())
+	}
+	q.Enqueue("a", PriorityBackground)
+	q.Enqueue("b", PriorityBackground)
+	q.Enqueue("c", PriorityStale)
+	q.Enqueue("b", PriorityMiss)
+	lease, _ := q.Lease("")
+	q.Ack(lease.Token)
+	q.Lease("")
+
+	// a restart loses the lease of c but not the key, nor the acked b
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	_, _ = f.WriteString(`{"op":"add","ke`)
+	_ = f.Close()
+	restarted := NewWorkQueue(config)
+	if err := restarted.Open(path); err != nil {
+		t.Fatalf("reopen failed, error: %s", err.Error())
+	}
+	if stats := restarted.Stats(); stats.Ready != 2 || stats.Priorities["stale"] != 1 || stats.Priorities["background"] != 1 {
+		t.Fatalf("unexpected queue after restart %+v", stats)
+	}
+	if lease, _ := restarted.Lease(""); lease.Key != "c" {
+		t.Fatalf("expect c first, but %s got", lease.Key)
+	}
+
+	// the file was compacted on open
+	records, err := readQueueLog(path)
+	if err != nil || len(records) != 2 {
+		t.Fatalf("expect the 2 queued keys in the file, but %+v got, error: %v", records, err)
+	}
+	restarted.AckKey("c")
+	if err := restarted.Compact(); err != nil {
+		t.Fatalf("compact failed, error: %s", err.Error())
+	}
+	if records, _ := readQueueLog(path); len(records) != 1 || records[0].Key != "a" {
+		t.Fatalf("expect only a left after compaction, but %+v got", records)
+	}
+}
+
+func TestWorkQueueCompact(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue.log")
+	q := NewWorkQueue(QueueConfig{Capacity: 10, Visibility: time.Minute, MaxAttempts: 5, SyncInterval: time.Millisecond})
+	if err := q.Open(path); err != nil {
+		t.Fatalf("open failed, error: %s", err.Error())
+	}
+
+	// changes made while the file is rewritten follow the keys
+	q.Enqueue("a", PriorityMiss)
+	q.mu.Lock()
+	q.log.beginRewrite()
+	records := q.records()
+	q.mu.Unlock()
+	q.Enqueue("b", PriorityMiss)
+	if err := q.log.rewrite(records); err != nil {
+		t.Fatalf("rewrite failed, error: %s", err.Error())
+	}
+	if records, _ := readQueueLog(path); len(records) != 2 || records[0].Key != "a" || records[1].Key != "b" {
+		t.Fatalf("expect the change made while compacting kept, but %+v got", records)
+	}
+
+	// a file bloated with keys that left the queue compacts itself
+	bloated := filepath.Join(t.TempDir(), "bloated.log")
+	q = NewWorkQueue(QueueConfig{Capacity: 10, Visibility: time.Minute, MaxAttempts: 5, SyncInterval: -1})
+	if err := q.Open(bloated); err != nil {
+		t.Fatalf("open failed, error: %s", err.Error())
+	}
+	for i := 0; i < minCompactRecords; i++ {
+		q.Enqueue("c", PriorityMiss)
+		lease, _ := q.Lease("")
+		q.Ack(lease.Token)
+	}
+	waitFor(t, "the file to be compacted", func() bool {
+		records, _ := readQueueLog(bloated)
+		return len(records) < minCompactRecords
+	})
+}
+
+func TestWorkQueueNack(t *testing.T) {
+	retry := utils.RetryPolicy{Attempts: 2, BaseDelay: time.Millisecond * 20, MaxDelay: time.Second}
+	q := NewWorkQueue(QueueConfig{Capacity: 10, Visibility: time.Minute, MaxAttempts: 1, Retry: retry, Quarantine: time.Millisecond * 50})
+	q.Enqueue("a", PriorityMiss)
+	lease, _ := q.Lease("")
+	if _, ok := q.Nack(lease.Token, Failure{Class: FailureTimeout, Message: "timeout"}); !ok {
+		t.Fatal("expect lease to be nacked")
+	}
+	if _, ok := q.Nack(lease.Token, Failure{}); ok {
+		t.Fatal("expect a lease to be nacked once")
+	}
+	state := q.State("a")
+	if state.State != KeyDelayed || state.Failures != 1 || state.LastFailure == nil || state.LastFailure.Class != FailureTimeout {
+		t.Fatalf("expect a delayed after a failure, but %+v got", state)
+	}
+	if _, ok := q.Lease(""); ok {
+		t.Fatal("expect delayed keys to be invisible")
+	}
+
+	// nacks don't count as attempts, a would be dead otherwise
+	time.Sleep(time.Millisecond * 30)
+	lease, ok := q.Lease("")
+	if !ok || lease.Key != "a" || lease.Attempts != 1 {
+		t.Fatalf("expect a leased again after its backoff, but %+v got", lease)
+	}
+	// the timeout was the upstream's fault, it doesn't count toward quarantine
+	q.Nack(lease.Token, Failure{Class: FailureEmpty, Message: "empty"})
+	if state := q.State("a"); state.State != KeyDelayed || state.Failures != 2 {
+		t.Fatalf("expect a delayed after a single empty payload, but %+v got", state)
+	}
+	waitFor(t, "a to be leased after its backoff", func() bool {
+		lease, ok = q.Lease("")
+		return ok
+	})
+	q.Nack(lease.Token, Failure{Class: FailureEmpty, Message: "empty"})
+	if state := q.State("a"); state.State != KeyQuarantined || state.LastFailure.Class != FailureEmpty {
+		t.Fatalf("expect a quarantined after two empty payloads, but %+v got", state)
+	}
+	if stats := q.Stats(); len(stats.Quarantined) != 1 || stats.Quarantined[0].Key != "a" {
+		t.Fatalf("expect a in quarantine, but %+v got", stats)
+	}
+	if err := q.Enqueue("a", PriorityMiss); err != ErrQuarantined || q.Len() != 0 {
+		t.Fatalf("expect quarantined keys not to be queued, but %v got", err)
+	}
+
+	time.Sleep(time.Millisecond * 60)
+	if q.Enqueue("a", PriorityMiss) != nil || q.Len() != 1 || q.State("a").Failures != 0 {
+		t.Fatalf("expect a queued afresh after its quarantine, but %+v got", q.State("a"))
+	}
+}
+
+func TestWorkQueueMaxFailures(t *testing.T) {
+	retry := utils.RetryPolicy{Attempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	q := NewWorkQueue(QueueConfig{Capacity: 10, Visibility: time.Minute, MaxAttempts: 1, Retry: retry, MaxFailures: 3})
+	q.Enqueue("a", PriorityMiss)
+	// the upstream's failures don't quarantine a, but they don't go on forever
+	for i := 0; i < 3; i++ {
+		var lease Lease
+		waitFor(t, "a to be leased after its backoff", func() (ok bool) {
+			lease, ok = q.Lease("")
+			return
+		})
+		q.Nack(lease.Token, Failure{Class: FailureTimeout, Message: "timeout"})
+	}
+	if state := q.State("a"); state.State != KeyDead || state.Failures != 3 {
+		t.Fatalf("expect a dead after 3 failures, but %+v got", state)
+	}
+	if q.Len() != 0 {
+		t.Fatalf("expect a out of the queue, but %d queued", q.Len())
+	}
+
+	// a key refreshed while it waits out its backoff is done
+	retry.BaseDelay, retry.MaxDelay = time.Minute, time.Minute
+	q = NewWorkQueue(QueueConfig{Capacity: 10, Visibility: time.Minute, MaxAttempts: 1, Retry: retry, MaxFailures: 3})
+	q.Enqueue("b", PriorityMiss)
+	lease, _ := q.Lease("")
+	q.Nack(lease.Token, Failure{Class: FailureTimeout, Message: "timeout"})
+	q.AckKey("b")
+	if state := q.State("b"); state.State != KeyIdle || q.Stats().Delayed != 0 {
+		t.Fatalf("expect b acknowledged while delayed, but %+v got", state)
+	}
+}
+
+func TestSendTimeoutCacheOrder(t *testing.T) {
+	g := NewGroup("timeout", 2<<10, GetterFunc(func(key string) ([]byte, error) { return nil, nil }))
+	for _, key := range []string{"cold", "warm", "hot"} {
+		_ = g.populateCache(key, ByteView{b: []byte(key)}, 1)
+	}
+	for key, hits := range map[string]int{"warm": 1, "hot": 3} {
+		for i := 0; i < hits; i++ {
+			g.mainCache.get(key)
+		}
+	}
+	for _, ele := range g.mainCache.lru.cache {
+		ele.Value.(*entry).timestamp = time.Now().Add(-time.Hour)
+	}
+
+	g.SendTimeoutCache(10)
+	for _, expect := range []string{"hot", "warm", "cold"} {
+		if lease, _ := g.LeaseMissed(""); lease.Key != expect || lease.Priority != PriorityBackground {
+			t.Fatalf("expect %s leased, but %+v got", expect, lease)
+		}
+	}
+}
+
+func TestMissedLease(t *testing.T) {
+	g := NewGroup("lease", 2<<10, GetterFunc(func(key string) ([]byte, error) { return []byte(key), nil }),
+		GroupWithQueue(QueueConfig{Capacity: 10, Visibility: time.Minute, MaxAttempts: 3}))
+	p := NewHTTPPool("localhost")
+	g.SendMissedCache("a")
+	g.SendMissedCache("b")
+
+	missed := func() (string, string) {
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, defaultBasePath+"lease?missed=1", nil))
+		return w.Body.String(), w.Header().Get(leaseHeader)
+	}
+	key, token := missed()
+	if key != "a" || token == "" {
+		t.Fatalf("expect a leased with a token, but %q %q got", key, token)
+	}
+	if code := postRequest(p, "lease", UpdateCacheRequest{Key: key, Value: "1", Lease: token}); code != http.StatusOK {
+		t.Fatalf("expect update to succeed, but %d got", code)
+	}
+	if key, _ = missed(); key != "b" {
+		t.Fatalf("expect b leased, but %q got", key)
+	}
+	// updates without a token acknowledge the key's leases
+	postRequest(p, "lease", UpdateCacheRequest{Key: "b", Value: "1"})
+	if key, _ = missed(); key != "" || g.queue.Len() != 0 {
+		t.Fatalf("expect the queue to be empty, but %q got", key)
+	}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, adminQueuePath+"?group=lease", nil))
+	var stats QueueStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil || stats.Ready != 0 || stats.Leased != 0 {
+		t.Fatalf("unexpected queue stats %s, error: %v", w.Body.String(), err)
+	}
+}
@@ -0,0 +1,184 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"stock_data_cache/utils"
+	"sync"
+	"time"
+)
+
+const (
+	queueOpAdd  = "add"
+	queueOpDone = "done"
+)
+
+// A queue file is compacted once it holds compactRatio records per key
+// queued, and at least minCompactRecords.
+const (
+	compactRatio      = 4
+	minCompactRecords = 1000
+)
+
+// A queueRecord is a change to a WorkQueue: a key queued with a priority,
+// or raised to it, or a key leaving the queue.
+type queueRecord struct {
+	Op       string   `json:"op"`
+	Key      string   `json:"key"`
+	Priority Priority `json:"priority,omitempty"`
+}
+
+// queueLog is the append-only file of the changes to a WorkQueue, one json
+// record per line. Appends are synced within syncInterval, see
+// QueueConfig.SyncInterval. It is safe for concurrent access.
+type queueLog struct {
+	path         string
+	syncInterval time.Duration
+
+	mu      sync.Mutex
+	file    *os.File
+	records int  // records in the file
+	pending bool // a sync of the latest appends is scheduled
+	// compacting holds the records appended while the file is rewritten, nil
+	// unless it is
+	compacting []queueRecord
+}
+
+// readQueueLog reads the records of the file at path, skipping corrupt lines,
+// e.g. one cut off by a crash.
+func readQueueLog(path string) ([]queueRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func(file *os.File) {
+		_ = file.Close()
+	}(file)
+
+	records := make([]queueRecord, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var r queueRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			fmt.Printf("queue log corrupt, file: %s, line: %d, error: %s\n", path, line, err.Error())
+			continue
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
+
+// append writes r to the end of the file.
+func (l *queueLog) append(r queueRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.compacting != nil {
+		l.compacting = append(l.compacting, r)
+	}
+	if l.file == nil {
+		return
+	}
+	b, _ := json.Marshal(r)
+	if _, err := l.file.Write(append(b, '\n')); err != nil {
+		fmt.Printf("append queue log failed, error: %s\n", err.Error())
+		return
+	}
+	l.records++
+	switch {
+	case l.syncInterval == 0:
+		l.syncLocked()
+	case l.syncInterval > 0 && !l.pending:
+		l.pending = true
+		time.AfterFunc(l.syncInterval, l.sync)
+	}
+}
+
+// sync flushes the appends to disk.
+func (l *queueLog) sync() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.syncLocked()
+}
+
+// syncLocked implements sync with l.mu held.
+func (l *queueLog) syncLocked() {
+	l.pending = false
+	if l.file == nil {
+		return
+	}
+	if err := l.file.Sync(); err != nil {
+		fmt.Printf("sync queue log failed, error: %s\n", err.Error())
+	}
+}
+
+// bloated reports whether the file holds more than compactRatio records per
+// key queued, and at least minCompactRecords, so that it is worth compacting.
+func (l *queueLog) bloated(queued int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.compacting == nil && l.records >= minCompactRecords && l.records > queued*compactRatio
+}
+
+// beginRewrite starts collecting the records appended from now on for
+// rewrite, it returns false if a rewrite is running already.
+func (l *queueLog) beginRewrite() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.compacting != nil {
+		return false
+	}
+	l.compacting = make([]queueRecord, 0)
+	return true
+}
+
+// rewrite replaces the file with records atomically, followed by the
+// records appended since beginRewrite, and appends to the new file from now
+// on. Appends go on to the old file while records are written.
+func (l *queueLog) rewrite(records []queueRecord) error {
+	tmp := l.path + ".tmp"
+	file, err := os.Create(tmp)
+	if err == nil {
+		err = writeRecords(file, records)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	appended := l.compacting
+	l.compacting = nil
+	if err == nil {
+		err = writeRecords(file, appended)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, l.path)
+	}
+	if err != nil {
+		if file != nil {
+			_ = file.Close()
+		}
+		_ = os.Remove(tmp)
+		return err
+	}
+	if l.file != nil {
+		_ = l.file.Close()
+	}
+	l.file = file
+	l.records = len(records) + len(appended)
+	return utils.SyncDir(l.path)
+}
+
+// writeRecords writes records to w, one json record per line.
+func writeRecords(w io.Writer, records []queueRecord) error {
+	bw := bufio.NewWriter(w)
+	for _, r := range records {
+		b, _ := json.Marshal(r)
+		_, _ = bw.Write(append(b, '\n'))
+	}
+	return bw.Flush()
+}
@@ -0,0 +1,392 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"stock_data_cache/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RolePrimary = "primary"
+	RoleReplica = "replica"
+)
+
+const (
+	OpSet    = "set"
+	OpDelete = "delete"
+)
+
+// DefaultReplicationLogSize is the number of writes a primary keeps for
+// replicas to catch up once one synced, replicas further behind sync the
+// whole cache.
+const DefaultReplicationLogSize = 100000
+
+// DefaultPullInterval is how often an up to date replica polls its primary.
+const DefaultPullInterval = time.Second
+
+// replicationBatch is the maximum number of writes pulled at once.
+const replicationBatch = 1000
+
+// A ReplicationOp is a write to a group's cache, Seq orders the writes of a
+// primary. Timestamp is the unix nanoseconds the primary cached the value at,
+// replicas expire it from then on.
+type ReplicationOp struct {
+	Seq       uint64 `json:"seq"`
+	Op        string `json:"op"`
+	Group     string `json:"group"`
+	Key       string `json:"key"`
+	Value     string `json:"value,omitempty"`
+	Version   int64  `json:"version,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+}
+
+// ReplicationResponse is a primary's answer to a replica's pull, Seq is the
+// primary's latest sequence number in Epoch.
+type ReplicationResponse struct {
+	Epoch string          `json:"epoch"`
+	Seq   uint64          `json:"seq"`
+	Ops   []ReplicationOp `json:"ops"`
+}
+
+// ReplicationLog keeps the latest writes of a node in a ring. Sequence
+// numbers start over in a new epoch, e.g. when a primary restarts. It is
+// safe for concurrent access.
+type ReplicationLog struct {
+	mu    sync.Mutex
+	epoch string
+	size  int
+	ops   []ReplicationOp // allocated once enabled, see enable
+	next  int             // index of the next write in ops
+	count int             // number of writes kept
+	seq   uint64
+}
+
+// NewReplicationLog create a new instance of ReplicationLog keeping size
+// writes once enabled, in a new epoch.
+func NewReplicationLog(size int) *ReplicationLog {
+	return &ReplicationLog{epoch: newLeaseToken(), size: size}
+}
+
+var replication = NewReplicationLog(DefaultReplicationLogSize)
+
+// enable makes the log keep writes from now on, e.g. once a replica synced
+// the whole cache: a node nobody replicates from only counts its writes.
+func (l *ReplicationLog) enable() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.ops == nil {
+		l.ops = make([]ReplicationOp, l.size)
+	}
+}
+
+// append numbers op with the next sequence number, or keeps its own if it
+// was replicated from a primary, and logs it if the log is enabled.
+func (l *ReplicationLog) append(op ReplicationOp) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if op.Seq == 0 {
+		op.Seq = l.seq + 1
+	}
+	l.seq = op.Seq
+	metrics.Set("replication_seq", float64(l.seq))
+	if l.ops == nil {
+		return
+	}
+	l.ops[l.next] = op
+	l.next = (l.next + 1) % len(l.ops)
+	if l.count < len(l.ops) {
+		l.count++
+	}
+}
+
+// reset empties the log and continues the sequence numbers of epoch after
+// seq, e.g. after a replica synced the whole cache of its primary.
+func (l *ReplicationLog) reset(epoch string, seq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.epoch, l.seq = epoch, seq
+	l.next, l.count = 0, 0
+}
+
+// Seq returns the epoch and its latest sequence number.
+func (l *ReplicationLog) Seq() (string, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.epoch, l.seq
+}
+
+// Since returns up to limit writes after seq in epoch, ok is false if some
+// of them are not kept anymore or the epoch is over.
+func (l *ReplicationLog) Since(epoch string, seq uint64, limit int) (ops []ReplicationOp, ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if epoch != l.epoch || seq > l.seq || l.seq-seq > uint64(l.count) {
+		return nil, false
+	}
+	ops = make([]ReplicationOp, 0)
+	for i := int(l.seq - seq); i > 0 && len(ops) < limit; i-- {
+		ops = append(ops, l.ops[(l.next-i+len(l.ops))%len(l.ops)])
+	}
+	return ops, true
+}
+
+// snapshot returns the cached values of every group as writes, numbered by
+// the sequence number they are consistent with: writes after it may or may
+// not be included, replaying them is harmless since writes are versioned.
+func snapshot() ReplicationResponse {
+	resp := ReplicationResponse{Ops: make([]ReplicationOp, 0)}
+	// the replica pulls the writes after the snapshot next
+	replication.enable()
+	resp.Epoch, resp.Seq = replication.Seq()
+	mu.RLock()
+	all := make([]*Group, 0, len(groups))
+	for _, g := range groups {
+		all = append(all, g)
+	}
+	mu.RUnlock()
+	for _, g := range all {
+		g.mainCache.mu.Lock()
+		if g.mainCache.lru != nil {
+			for ele := g.mainCache.lru.ll.Back(); ele != nil; ele = ele.Prev() {
+				kv := ele.Value.(*entry)
+				resp.Ops = append(resp.Ops, ReplicationOp{
+					Op:        OpSet,
+					Group:     g.name,
+					Key:       kv.key,
+					Value:     kv.value.(ByteView).String(),
+					Version:   kv.version,
+					Timestamp: kv.timestamp.UnixNano(),
+				})
+			}
+		}
+		g.mainCache.mu.Unlock()
+	}
+	return resp
+}
+
+// replicate logs a write of this node, replicas don't log their own writes
+// since their logs follow the sequence numbers of their primary.
+func replicate(op ReplicationOp) {
+	if Role() == RolePrimary {
+		replication.append(op)
+	}
+}
+
+// apply makes a replicated write to the cache of its group and logs it with
+// its sequence number, so that the replica can serve replicas itself once it
+// is promoted.
+func apply(op ReplicationOp) {
+	g := GetGroup(op.Group)
+	if g == nil {
+		fmt.Printf("replicate failed, no such group: %s\n", op.Group)
+		return
+	}
+	switch op.Op {
+	case OpSet:
+		value := ByteView{b: []byte(op.Value)}
+		if err := g.reject(op.Key, value); err != nil {
+			break
+		}
+		timestamp := time.Now()
+		if op.Timestamp != 0 {
+			timestamp = time.Unix(0, op.Timestamp)
+		}
+		// writes older than the cached value were superseded on the primary too
+		_ = g.mainCache.add(op.Key, value, op.Version, timestamp)
+	case OpDelete:
+		g.mainCache.remove(op.Key)
+	}
+	if op.Seq != 0 {
+		replication.append(op)
+	}
+}
+
+// A Replica pulls the writes of a primary. It is safe for concurrent access.
+type Replica struct {
+	primary  string
+	interval time.Duration
+	mu       sync.Mutex
+	epoch    string
+	seq      uint64
+	cancel   context.CancelFunc
+}
+
+var (
+	roleMu  sync.RWMutex
+	role    = RolePrimary
+	replica *Replica
+)
+
+// StartReplica makes this node a replica of the primary at base URL primary,
+// e.g. "http://10.0.0.1:7296", until it is promoted. A replica of another
+// primary stops pulling from it.
+func StartReplica(primary string, interval time.Duration) *Replica {
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Replica{primary: strings.TrimRight(primary, "/"), interval: interval, cancel: cancel}
+	roleMu.Lock()
+	if replica != nil {
+		replica.cancel()
+	}
+	role, replica = RoleReplica, r
+	roleMu.Unlock()
+	go r.run(ctx)
+	return r
+}
+
+// FollowLeader ties replication to election e: the leader is the primary,
+// the others replicate from it, pulling every interval once up to date.
+func FollowLeader(e *Election, interval time.Duration) {
+	e.OnLeader(func(leader string) {
+		if leader == e.config.ID {
+			if Role() == RoleReplica {
+				fmt.Printf("promoted to primary at seq %d\n", Promote())
+			}
+			return
+		}
+		if Primary() != strings.TrimRight(leader, "/") {
+			fmt.Printf("replicate from leader %s\n", leader)
+			StartReplica(leader, interval)
+		}
+	})
+}
+
+// Role returns the replication role of this node.
+func Role() string {
+	roleMu.RLock()
+	defer roleMu.RUnlock()
+	return role
+}
+
+// Primary returns the base URL of this node's primary, or "" if it is one.
+func Primary() string {
+	roleMu.RLock()
+	defer roleMu.RUnlock()
+	if replica == nil {
+		return ""
+	}
+	return replica.primary
+}
+
+// Promote makes this node a primary, it stops pulling from its primary and
+// accepts writes. It starts a new epoch: the replica may have missed writes
+// its primary made, so replicas following it can't resume from their
+// sequence numbers and sync the whole cache. It returns the sequence number
+// it was promoted at.
+func Promote() uint64 {
+	roleMu.Lock()
+	defer roleMu.Unlock()
+	if replica != nil {
+		replica.cancel()
+		replica = nil
+	}
+	role = RolePrimary
+	_, seq := replication.Seq()
+	replication.reset(newLeaseToken(), seq)
+	return seq
+}
+
+func (r *Replica) run(ctx context.Context) {
+	for ctx.Err() == nil {
+		caughtUp, err := r.pull(ctx)
+		if err != nil {
+			fmt.Printf("replicate failed, primary: %s, error: %s\n", r.primary, err.Error())
+		}
+		if caughtUp || err != nil {
+			sleep(ctx, r.interval)
+		}
+	}
+}
+
+// pull applies the next writes of the primary, or all of its cache at first
+// and whenever the writes the replica misses aren't kept anymore. caughtUp
+// reports whether the replica has every write of the primary.
+func (r *Replica) pull(ctx context.Context) (caughtUp bool, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	full := r.epoch == ""
+	var b []byte
+	if !full {
+		query := url.Values{}
+		query.Set("epoch", r.epoch)
+		query.Set("since", strconv.FormatUint(r.seq, 10))
+		query.Set("limit", strconv.Itoa(replicationBatch))
+		b, err = utils.DoGetRequest(r.primary+adminReplicationPath+"?"+query.Encode(), FetchTimeout)
+		var statusErr *utils.StatusError
+		if errors.As(err, &statusErr) && statusErr.Code == http.StatusGone {
+			fmt.Printf("replica fell behind, sync from %s\n", r.primary)
+			full = true
+		}
+	}
+	if full {
+		b, err = utils.DoGetRequest(r.primary+adminReplicationPath+"?snapshot=1", FetchTimeout*6)
+	}
+	if err != nil {
+		return false, err
+	}
+	var resp ReplicationResponse
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return false, err
+	}
+
+	for _, op := range resp.Ops {
+		// promoted while pulling, the cache is ours now
+		if ctx.Err() != nil {
+			return false, nil
+		}
+		apply(op)
+		if op.Seq > r.seq {
+			r.seq = op.Seq
+		}
+	}
+	if full {
+		// keys the primary doesn't cache were deleted in the writes missed
+		removed := retainSnapshot(resp.Ops)
+		if removed > 0 {
+			fmt.Printf("replica dropped %d keys missing from the snapshot of %s\n", removed, r.primary)
+		}
+		r.epoch, r.seq = resp.Epoch, resp.Seq
+		replication.reset(resp.Epoch, resp.Seq)
+		fmt.Printf("replica synced, primary: %s, keys: %d, seq: %d\n", r.primary, len(resp.Ops), r.seq)
+	}
+	metrics.Set("replication_lag", float64(resp.Seq-r.seq))
+	return r.seq >= resp.Seq, nil
+}
+
+// retainSnapshot removes the cached keys of every group that are not in the
+// snapshot ops, it returns the number removed.
+func retainSnapshot(ops []ReplicationOp) int {
+	keep := make(map[string]map[string]bool)
+	for _, op := range ops {
+		if keep[op.Group] == nil {
+			keep[op.Group] = make(map[string]bool)
+		}
+		keep[op.Group][op.Key] = true
+	}
+	mu.RLock()
+	all := make([]*Group, 0, len(groups))
+	for _, g := range groups {
+		all = append(all, g)
+	}
+	mu.RUnlock()
+	removed := 0
+	for _, g := range all {
+		removed += g.mainCache.retain(keep[g.name])
+	}
+	return removed
+}
+
+// Seq returns the sequence number of the last write the replica applied.
+func (r *Replica) Seq() uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.seq
+}
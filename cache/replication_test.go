@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReplicationLog(t *testing.T) {
+	l := NewReplicationLog(3)
+	l.append(ReplicationOp{Op: OpSet, Key: "unlogged"})
+	if _, ok := l.Since(l.epoch, 0, 10); ok {
+		t.Fatal("expect no write kept before the log is enabled")
+	}
+	l.enable()
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		l.append(ReplicationOp{Op: OpSet, Key: key})
+	}
+	epoch, seq := l.Seq()
+	if seq != 6 {
+		t.Fatalf("expect seq 6, but %d got", seq)
+	}
+	if _, ok := l.Since(epoch, 2, 10); ok {
+		t.Fatal("expect writes no longer kept to be gone")
+	}
+	if _, ok := l.Since("other", 4, 10); ok {
+		t.Fatal("expect writes of another epoch to be gone")
+	}
+	ops, ok := l.Since(epoch, 3, 2)
+	if !ok || len(ops) != 2 || ops[0].Key != "c" || ops[1].Seq != 5 {
+		t.Fatalf("unexpected writes %+v", ops)
+	}
+	if ops, ok := l.Since(epoch, 6, 10); !ok || len(ops) != 0 {
+		t.Fatal("expect no writes after the latest")
+	}
+}
+
+func TestReplica(t *testing.T) {
+	g := NewGroup("replicated", 2<<10, GetterFunc(func(key string) ([]byte, error) { return nil, nil }),
+		GroupWithMode(ModeMaster))
+	// deleted on the primary in writes the replica missed
+	_ = g.mainCache.add("c", ByteView{b: []byte("1")}, 1, time.Now())
+	fetched := time.Now().Add(-time.Minute).Round(0)
+	responses := map[string]ReplicationResponse{
+		"snapshot": {Epoch: "e1", Seq: 2, Ops: []ReplicationOp{
+			{Op: OpSet, Group: "replicated", Key: "a", Value: "1", Version: 1},
+			{Op: OpSet, Group: "replicated", Key: "b", Value: "1", Version: 1},
+		}},
+		"2": {Epoch: "e1", Seq: 4, Ops: []ReplicationOp{
+			{Seq: 3, Op: OpSet, Group: "replicated", Key: "a", Value: "2", Version: 2, Timestamp: fetched.UnixNano()},
+			{Seq: 4, Op: OpDelete, Group: "replicated", Key: "b"},
+		}},
+	}
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		since := r.URL.Query().Get("since")
+		if r.URL.Query().Get("snapshot") != "" {
+			since = "snapshot"
+		}
+		resp, ok := responses[since]
+		if !ok {
+			resp = ReplicationResponse{Epoch: "e1", Seq: 4, Ops: []ReplicationOp{}}
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	defer primary.Close()
+
+	r := StartReplica(primary.URL, time.Millisecond*10)
+	defer Promote()
+	for deadline := time.Now().Add(time.Second); r.Seq() < 4; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expect the replica to catch up, but it is at %d", r.Seq())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if v, _ := g.mainCache.peek("a"); v.String() != "2" {
+		t.Fatalf("expect replicated value 2, but %q got", v)
+	}
+	if _, ok := g.mainCache.peek("b"); ok {
+		t.Fatal("expect replicated invalidation")
+	}
+	if timestamp, _, _, _ := g.mainCache.usage("a"); !timestamp.Equal(fetched) {
+		t.Fatalf("expect the timestamp of the primary %s, but %s got", fetched, timestamp)
+	}
+	if _, ok := g.mainCache.peek("c"); ok {
+		t.Fatal("expect a key missing from the snapshot to be dropped")
+	}
+
+	p := NewHTTPPool("localhost")
+	if code := postUpdate(p, "replicated", "a", []byte("3")); code != http.StatusForbidden {
+		t.Fatalf("expect a replica to reject writes, but %d got", code)
+	}
+	if seq := Promote(); seq != 4 || Role() != RolePrimary {
+		t.Fatalf("expect promotion at seq 4, but %d got", seq)
+	}
+	if code := postUpdate(p, "replicated", "a", []byte("3")); code != http.StatusOK {
+		t.Fatalf("expect a promoted replica to accept writes, but %d got", code)
+	}
+	// replicas of the old primary sync the whole cache of the promoted one
+	if _, ok := replication.Since("e1", 4, 10); ok {
+		t.Fatal("expect the writes of the old epoch to be gone")
+	}
+	if resp := snapshot(); resp.Epoch == "e1" || resp.Seq != 5 {
+		t.Fatalf("expect a new epoch at seq 5, but %s %d got", resp.Epoch, resp.Seq)
+	}
+}
@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// priceLimit returns the daily price limit of a quote as a fraction of its
+// previous close, or 0 if its price isn't limited.
+func priceLimit(q Quote) float64 {
+	// newly listed stocks are named N... on their first day and C... on
+	// the following ones, their prices aren't limited
+	if strings.HasPrefix(q.Name, "N") || strings.HasPrefix(q.Name, "C") {
+		return 0
+	}
+	switch {
+	case strings.HasPrefix(q.Symbol, "bj"):
+		return 0.3
+	case strings.HasPrefix(q.Symbol, "sh688"), strings.HasPrefix(q.Symbol, "sh689"),
+		strings.HasPrefix(q.Symbol, "sz300"), strings.HasPrefix(q.Symbol, "sz301"):
+		return 0.2
+	case strings.Contains(q.Name, "ST"):
+		return 0.05
+	}
+	return 0.1
+}
+
+// checkLimit returns an ErrOutOfLimit PayloadError if the quote's price is
+// beyond the limit-up or limit-down price of its previous close. Zero prices,
+// quoted before the first trade, are fine.
+func checkLimit(provider string, q Quote) error {
+	limit := priceLimit(q)
+	if limit == 0 || q.PrevClose <= 0 || q.Price == 0 {
+		return nil
+	}
+	// limit prices are rounded to cents
+	up := math.Round(q.PrevClose*(1+limit)*100)/100 + 0.005
+	down := math.Round(q.PrevClose*(1-limit)*100)/100 - 0.005
+	if q.Price > up || q.Price < down {
+		return &PayloadError{Provider: provider, Kind: ErrOutOfLimit,
+			Detail: fmt.Sprintf("%s price %.3f, previous close %.3f", q.Symbol, q.Price, q.PrevClose)}
+	}
+	return nil
+}
+
+// checkValue returns a PayloadError if value must not be cached for key:
+// it isn't a valid payload, a price is out of its daily limit, or a quote is
+// older than the cached one. Values of groups using a getter aren't checked.
+func (g *Group) checkValue(key string, value []byte) error {
+	if g.provider == nil {
+		return nil
+	}
+	symbols, err := g.provider.Symbols(key)
+	if err != nil {
+		return err
+	}
+	quotes, err := validate(g.provider, symbols, value)
+	if err != nil {
+		return err
+	}
+	for _, q := range quotes {
+		if err := checkLimit(g.provider.Name(), q); err != nil {
+			return err
+		}
+	}
+
+	cached, ok := g.mainCache.peek(key)
+	if !ok {
+		return nil
+	}
+	// a cached value that doesn't parse can't be compared to
+	old, err := g.provider.Parse(cached.ByteSlice())
+	if err != nil {
+		return nil
+	}
+	cachedQuotes := make(map[string]Quote, len(old))
+	for _, q := range old {
+		cachedQuotes[q.Symbol] = q
+	}
+	for _, q := range quotes {
+		if o, ok := cachedQuotes[q.Symbol]; ok && q.Time.Before(o.Time) {
+			return &PayloadError{Provider: g.provider.Name(), Kind: ErrOutdated,
+				Detail: fmt.Sprintf("%s quote at %s, cached at %s", q.Symbol, q.Time, o.Time)}
+		}
+	}
+	return nil
+}
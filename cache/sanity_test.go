@@ -0,0 +1,102 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func postUpdate(p *HTTPPool, group, key string, value []byte) int {
+	return postRequest(p, group, UpdateCacheRequest{Key: key, Value: string(value)})
+}
+
+func postRequest(p *HTTPPool, group string, req UpdateCacheRequest) int {
+	b, _ := json.Marshal(req)
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodPost, defaultBasePath+group, bytes.NewReader(b)))
+	return w.Code
+}
+
+func TestCheckLimit(t *testing.T) {
+	cases := []struct {
+		symbol, name string
+		price        float64
+		ok           bool
+	}{
+		{"sz000001", "平安银行", 11.0, true},
+		{"sz000001", "平安银行", 11.01, false},
+		{"sz000001", "平安银行", 9.0, true},
+		{"sz000001", "平安银行", 8.99, false},
+		{"sz300750", "宁德时代", 12.0, true},
+		{"sh688981", "中芯国际", 12.01, false},
+		{"bj430047", "诺思兰德", 13.0, true},
+		{"sz000001", "*ST平安", 10.51, false},
+		{"sz301001", "N凯淳", 30.0, true},
+	}
+	for _, c := range cases {
+		q := Quote{Symbol: c.symbol, Name: c.name, PrevClose: 10, Price: c.price}
+		if err := checkLimit(Sina, q); (err == nil) != c.ok {
+			t.Fatalf("%s %s at %.2f: expect ok %v, but %v got", c.symbol, c.name, c.price, c.ok, err)
+		}
+	}
+}
+
+func TestUpdateCacheSanity(t *testing.T) {
+	sina := NewSinaProvider()
+	NewGroup("sanity", 2<<10, nil, GroupWithProvider(sina))
+	p := NewHTTPPool("localhost")
+	key := "http://hq.sinajs.cn/list=sz000001"
+
+	q := testQuote
+	if code := postUpdate(p, "sanity", key, sina.Format([]Quote{q})); code != http.StatusOK {
+		t.Fatalf("expect valid update to be accepted, but %d got", code)
+	}
+
+	before := metrics.Get("update_rejected_total", "group", "sanity", "reason", ErrOutdated.Error())
+	older := q
+	older.Time = q.Time.Add(-time.Minute)
+	if code := postUpdate(p, "sanity", key, sina.Format([]Quote{older})); code != http.StatusUnprocessableEntity {
+		t.Fatalf("expect outdated update to be rejected, but %d got", code)
+	}
+	if after := metrics.Get("update_rejected_total", "group", "sanity", "reason", ErrOutdated.Error()); after != before+1 {
+		t.Fatal("expect rejection to be counted")
+	}
+
+	limitUp := q
+	limitUp.Time = q.Time.Add(time.Minute)
+	limitUp.Price = 19.5
+	if code := postUpdate(p, "sanity", key, sina.Format([]Quote{limitUp})); code != http.StatusUnprocessableEntity {
+		t.Fatalf("expect update beyond limit up to be rejected, but %d got", code)
+	}
+
+	truncated := sina.Format([]Quote{q})
+	truncated = truncated[:len(truncated)/2]
+	if code := postUpdate(p, "sanity", key, truncated); code != http.StatusUnprocessableEntity {
+		t.Fatalf("expect truncated update to be rejected, but %d got", code)
+	}
+
+	if v, _ := GetGroup("sanity").mainCache.peek(key); !bytes.Equal(v.ByteSlice(), sina.Format([]Quote{q})) {
+		t.Fatal("expect rejected updates not to overwrite the cached value")
+	}
+}
+
+func TestWritePathSanity(t *testing.T) {
+	sina := NewSinaProvider()
+	g := NewGroup("sanitized", 2<<10, nil, GroupWithProvider(sina))
+	limitUp := testQuote
+	limitUp.Price = 19.5
+	value := sina.Format([]Quote{limitUp})
+
+	var rejected *RejectedError
+	if err := g.populateCache("sz000001", ByteView{b: value}, 1); !errors.As(err, &rejected) {
+		t.Fatalf("expect a fetched value beyond limit up to be rejected, but %v got", err)
+	}
+	apply(ReplicationOp{Op: OpSet, Group: "sanitized", Key: "sz000001", Value: string(value), Version: 1})
+	if _, ok := g.mainCache.peek("sz000001"); ok {
+		t.Fatal("expect a replicated value beyond limit up not to be cached")
+	}
+}
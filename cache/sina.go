@@ -1,20 +1,221 @@
 package cache
 
 import (
-	"github.com/axgle/mahonia"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
 	"stock_data_cache/utils"
+	"strconv"
+	"strings"
 	"time"
 )
 
+const sinaQuoteApi = "http://hq.sinajs.cn/list="
+const sinaKLineApi = "http://money.finance.sina.com.cn/quotes_service/api/json_v2.php/CN_MarketDataService.getKLineData"
+
+// SinaProvider fetches quotes from hq.sinajs.cn and k-line bars from its
+// json api.
+type SinaProvider struct {
+	httpProvider
+	klineApi string
+}
+
+// NewSinaProvider create a new instance of SinaProvider
+func NewSinaProvider() *SinaProvider {
+	return &SinaProvider{httpProvider{
+		api: sinaQuoteApi,
+		headers: map[string]string{
+			"Accept":  "application/json",
+			"Referer": "https://finance.sina.com.cn/",
+		},
+		charset: "gbk",
+	}, sinaKLineApi}
+}
+
+// Name implements Provider
+func (p *SinaProvider) Name() string {
+	return Sina
+}
+
+// Symbols implements Provider
+func (p *SinaProvider) Symbols(key string) ([]string, error) {
+	return splitSymbols(key)
+}
+
+// Fetch implements Provider
+func (p *SinaProvider) Fetch(ctx context.Context, symbols []string, timeout time.Duration) ([]byte, error) {
+	defer utils.TimeTrack(time.Now(), "SinaProvider.Fetch")
+	return p.get(ctx, strings.Join(symbols, ","), timeout)
+}
+
+// Validate implements Provider, unknown symbols come back as
+// var hq_str_sz000000="";
+func (p *SinaProvider) Validate(b []byte) error {
+	if err := validatePayload(Sina, b); err != nil {
+		return err
+	}
+	return validateAssignments(Sina, b, "var hq_str_")
+}
+
+// Parse implements Provider, each line looks like
+// var hq_str_sh600000="name,open,prev_close,price,high,low,...,date,time,00";
+func (p *SinaProvider) Parse(b []byte) ([]Quote, error) {
+	quotes := make([]Quote, 0)
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		symbol, content, err := splitAssignment(string(line), "var hq_str_")
+		if err != nil {
+			return nil, err
+		}
+		if content == "" {
+			continue
+		}
+		fields := strings.Split(content, ",")
+		if len(fields) < 32 {
+			return nil, fmt.Errorf("sina quote %s has %d fields", symbol, len(fields))
+		}
+		q := Quote{Symbol: symbol, Name: fields[0]}
+		if err := parseFloats(fields, map[int]*float64{
+			1: &q.Open, 2: &q.PrevClose, 3: &q.Price, 4: &q.High, 5: &q.Low, 8: &q.Volume, 9: &q.Amount,
+		}); err != nil {
+			return nil, fmt.Errorf("sina quote %s: %s", symbol, err.Error())
+		}
+		if q.Time, err = time.ParseInLocation("2006-01-02 15:04:05", fields[30]+" "+fields[31], chinaZone); err != nil {
+			return nil, fmt.Errorf("sina quote %s: %s", symbol, err.Error())
+		}
+		quotes = append(quotes, q)
+	}
+	return quotes, nil
+}
+
+// Split implements Splitter
+func (p *SinaProvider) Split(b []byte) (map[string][]byte, error) {
+	return splitLines(Sina, b, "var hq_str_")
+}
+
+// Format implements Provider
+func (p *SinaProvider) Format(quotes []Quote) []byte {
+	var buf bytes.Buffer
+	for _, q := range quotes {
+		fields := []string{
+			q.Name, formatPrice(q.Open), formatPrice(q.PrevClose), formatPrice(q.Price),
+			formatPrice(q.High), formatPrice(q.Low), formatPrice(q.Price), formatPrice(q.Price),
+			strconv.FormatFloat(q.Volume, 'f', 0, 64), strconv.FormatFloat(q.Amount, 'f', 3, 64),
+		}
+		// five levels of bid/ask volume and price are not normalized
+		for i := 0; i < 20; i++ {
+			fields = append(fields, "0")
+		}
+		t := q.Time.In(chinaZone)
+		fields = append(fields, t.Format("2006-01-02"), t.Format("15:04:05"), "00")
+		fmt.Fprintf(&buf, "var hq_str_%s=\"%s\";\n", q.Symbol, strings.Join(fields, ","))
+	}
+	return buf.Bytes()
+}
+
+// FetchBars implements BarFetcher, the api answers
+// [{"day":"2021-08-20","open":"17.500","high":"17.900","low":"17.300","close":"17.800","volume":"123456700"}]
+// with "day" also holding the time for minute bars.
+func (p *SinaProvider) FetchBars(symbol string, scale, count int, timeout time.Duration) ([]Bar, error) {
+	defer utils.TimeTrack(time.Now(), "SinaProvider.FetchBars")
+
+	url := fmt.Sprintf("%s?symbol=%s&scale=%d&ma=no&datalen=%d", p.klineApi, symbol, scale, count)
+	b, err := fetch(context.Background(), url, p.headers, p.charset, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if err := validatePayload(Sina, b); err != nil {
+		return nil, err
+	}
+	var items []map[string]string
+	if err := json.Unmarshal(b, &items); err != nil {
+		return nil, &PayloadError{Provider: Sina, Kind: ErrMalformed, Detail: err.Error()}
+	}
+	bars := make([]Bar, 0, len(items))
+	for _, item := range items {
+		var bar Bar
+		layout := "2006-01-02 15:04:05"
+		if len(item["day"]) == len("2006-01-02") {
+			layout = "2006-01-02"
+		}
+		if bar.Time, err = time.ParseInLocation(layout, item["day"], chinaZone); err != nil {
+			return nil, &PayloadError{Provider: Sina, Kind: ErrMalformed, Detail: err.Error()}
+		}
+		fields := []string{item["open"], item["high"], item["low"], item["close"], item["volume"]}
+		if err := parseFloats(fields, map[int]*float64{
+			0: &bar.Open, 1: &bar.High, 2: &bar.Low, 3: &bar.Close, 4: &bar.Volume,
+		}); err != nil {
+			return nil, &PayloadError{Provider: Sina, Kind: ErrMalformed, Detail: err.Error()}
+		}
+		bars = append(bars, bar)
+	}
+	if len(bars) == 0 {
+		return nil, &PayloadError{Provider: Sina, Kind: ErrEmpty, Detail: "no bars for " + symbol}
+	}
+	sort.Slice(bars, func(i, j int) bool { return bars[i].Time.Before(bars[j].Time) })
+	return bars, nil
+}
+
+// RequestSina requests url from sina and decodes the response, which is GBK
+// unless its Content-Type says otherwise, e.g. for the k-line json api.
 func RequestSina(url string, timeout time.Duration) (value string, err error) {
 	defer utils.TimeTrack(time.Now(), "RequestSina")
 
-	headers := make(map[string]string)
-	headers["Accept"] = "application/json"
-	headers["Referer"] = "https://finance.sina.com.cn/"
-
-	opts := []utils.RequestOption{utils.RequestWithHeaders(headers)}
-	b, err := utils.DoGetRequest(url, timeout, opts...)
-	value = mahonia.NewDecoder("gbk").ConvertString(string(b))
+	p := NewSinaProvider()
+	b, err := fetch(context.Background(), url, p.headers, p.charset, timeout)
+	value = string(b)
 	return
 }
+
+// validateAssignments rejects `<prefix><symbol>="";` lines of symbols the
+// provider has no data for.
+func validateAssignments(provider string, b []byte, prefix string) error {
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		symbol, content, err := splitAssignment(string(line), prefix)
+		if err != nil {
+			return &PayloadError{Provider: provider, Kind: ErrMalformed, Detail: err.Error()}
+		}
+		if strings.TrimSpace(content) == "" {
+			return &PayloadError{Provider: provider, Kind: ErrEmpty, Detail: "no data for " + symbol}
+		}
+	}
+	return nil
+}
+
+// splitAssignment splits a `<prefix><symbol>="<content>";` line.
+func splitAssignment(line, prefix string) (symbol, content string, err error) {
+	line = strings.TrimSuffix(line, ";")
+	i := strings.Index(line, "=")
+	if !strings.HasPrefix(line, prefix) || i < 0 {
+		return "", "", fmt.Errorf("malformed line: %.64s", line)
+	}
+	symbol = line[len(prefix):i]
+	content = line[i+1:]
+	if len(content) < 2 || content[0] != '"' || content[len(content)-1] != '"' {
+		return "", "", fmt.Errorf("malformed line: %.64s", line)
+	}
+	return symbol, content[1 : len(content)-1], nil
+}
+
+// parseFloats parses fields at the given indexes into the given targets.
+func parseFloats(fields []string, targets map[int]*float64) (err error) {
+	for i, f := range targets {
+		if *f, err = strconv.ParseFloat(fields[i], 64); err != nil {
+			return fmt.Errorf("field %d: %s", i, err.Error())
+		}
+	}
+	return nil
+}
+
+func formatPrice(f float64) string {
+	return strconv.FormatFloat(f, 'f', 3, 64)
+}
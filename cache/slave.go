@@ -0,0 +1,410 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"stock_data_cache/utils"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultHeartbeatInterval is how often slaves send heartbeats
+	DefaultHeartbeatInterval = time.Second * 10
+	// DefaultSlaveTimeout is how long after its last request a slave is dead
+	DefaultSlaveTimeout = time.Second * 30
+)
+
+// latencyDecay weights the latest update in a slave's latency.
+const latencyDecay = 0.2
+
+// SlaveRequest is the body of a slave's registration or heartbeat.
+// Capabilities are e.g. the providers the slave can fetch from.
+type SlaveRequest struct {
+	ID           string   `json:"id"`
+	Capabilities []string `json:"capabilities,omitempty"`
+}
+
+// SlaveStats is what the master knows about a slave. Fetched counts its
+// accepted updates, Failed its rejected updates and expired leases, and
+// Latency is the exponentially weighted time from lease to update.
+type SlaveStats struct {
+	ID           string    `json:"id"`
+	Capabilities []string  `json:"capabilities"`
+	Registered   time.Time `json:"registered"`
+	LastSeen     time.Time `json:"last_seen"`
+	Alive        bool      `json:"alive"`
+	Fetched      int64     `json:"fetched"`
+	Failed       int64     `json:"failed"`
+	FailureRate  float64   `json:"failure_rate"`
+	LatencyMs    float64   `json:"latency_ms"`
+}
+
+// SlaveRegistry tracks the slaves of a master. It is safe for concurrent
+// access.
+type SlaveRegistry struct {
+	mu      sync.Mutex
+	timeout time.Duration
+	slaves  map[string]*SlaveStats
+}
+
+// NewSlaveRegistry create a new instance of SlaveRegistry, slaves not seen
+// for timeout are dead.
+func NewSlaveRegistry(timeout time.Duration) *SlaveRegistry {
+	return &SlaveRegistry{
+		timeout: timeout,
+		slaves:  make(map[string]*SlaveStats),
+	}
+}
+
+var slaves = NewSlaveRegistry(DefaultSlaveTimeout)
+
+// Register adds a slave, or updates the capabilities of a known one.
+func (r *SlaveRegistry) Register(id string, capabilities []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	s, ok := r.slaves[id]
+	if !ok {
+		s = &SlaveStats{ID: id, Registered: now}
+		r.slaves[id] = s
+	}
+	s.Capabilities = capabilities
+	s.LastSeen = now
+	s.Alive = true
+}
+
+// Heartbeat marks a slave as seen, it returns false if it is unknown.
+func (r *SlaveRegistry) Heartbeat(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.slaves[id]
+	if !ok {
+		return false
+	}
+	s.LastSeen = time.Now()
+	s.Alive = true
+	return true
+}
+
+// succeeded records an accepted update of a slave, latency is the time since
+// its lease or 0 if unknown.
+func (r *SlaveRegistry) succeeded(id string, latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	s, ok := r.slaves[id]
+	if !ok {
+		return
+	}
+	s.Fetched++
+	if latency > 0 {
+		ms := float64(latency) / float64(time.Millisecond)
+		if s.LatencyMs == 0 {
+			s.LatencyMs = ms
+		} else {
+			s.LatencyMs = (1-latencyDecay)*s.LatencyMs + latencyDecay*ms
+		}
+	}
+	s.LastSeen = time.Now()
+	s.Alive = true
+}
+
+// failed records a rejected update or an expired lease of a slave.
+func (r *SlaveRegistry) failed(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok := r.slaves[id]; ok {
+		s.Failed++
+	}
+}
+
+// reap marks the slaves not seen for the timeout as dead and returns the ones
+// that just died.
+func (r *SlaveRegistry) reap(now time.Time) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dead := make([]string, 0)
+	for id, s := range r.slaves {
+		if s.Alive && now.Sub(s.LastSeen) >= r.timeout {
+			s.Alive = false
+			dead = append(dead, id)
+		}
+	}
+	return dead
+}
+
+// Stats returns the stats of every slave, ordered by ID.
+func (r *SlaveRegistry) Stats() []SlaveStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	stats := make([]SlaveStats, 0, len(r.slaves))
+	for _, s := range r.slaves {
+		stat := *s
+		if total := s.Fetched + s.Failed; total > 0 {
+			stat.FailureRate = float64(s.Failed) / float64(total)
+		}
+		stats = append(stats, stat)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].ID < stats[j].ID })
+	return stats
+}
+
+// reapSlaves returns the keys leased by slaves that just died to the queues
+// of every group.
+func reapSlaves() {
+	dead := slaves.reap(time.Now())
+	if len(dead) == 0 {
+		return
+	}
+	mu.RLock()
+	all := make([]*Group, 0, len(groups))
+	for _, g := range groups {
+		all = append(all, g)
+	}
+	mu.RUnlock()
+	for _, id := range dead {
+		for _, g := range all {
+			n := g.queue.Release(id)
+			fmt.Printf("slave dead, id: %s, group: %s, released: %d\n", id, g.name, n)
+		}
+	}
+}
+
+// A Slave refreshes the missed keys of a group on a master: it leases keys
+// from the master, fetches them from the group's upstreams and sends the
+// values back.
+type Slave struct {
+	id           string
+	master       string
+	group        *Group
+	workers      int
+	capabilities []string
+}
+
+// NewSlave create a new instance of Slave with id for the group of the same
+// name on the master at URL master, e.g. "http://localhost:7296". Its
+// capabilities are the providers of group.
+func NewSlave(id, master string, group *Group, workers int) *Slave {
+	capabilities := make([]string, 0)
+	if group.provider != nil {
+		for _, p := range append([]Provider{group.provider}, group.fallbacks...) {
+			capabilities = append(capabilities, p.Name())
+		}
+	}
+	return &Slave{
+		id:           id,
+		master:       strings.TrimRight(master, "/"),
+		group:        group,
+		workers:      workers,
+		capabilities: capabilities,
+	}
+}
+
+// Run registers with the master, then sends heartbeats and refreshes keys
+// with the slave's workers until ctx is done.
+func (s *Slave) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		s.heartbeats(ctx)
+	}()
+	update := s.Update
+	if s.group.batchSymbols > 1 {
+		update = s.UpdateBatch
+	}
+	for i := 0; i < s.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				// upstream requests are paced by the per-host rate limiters
+				empty, err := update(ctx)
+				if empty || errors.Is(err, utils.ErrBreakerOpen) {
+					sleep(ctx, time.Second*10)
+				} else if err != nil {
+					sleep(ctx, time.Second)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// heartbeats registers with the master and then sends heartbeats, and
+// registers again if the master forgot the slave, e.g. after a restart.
+func (s *Slave) heartbeats(ctx context.Context) {
+	registered := false
+	for ctx.Err() == nil {
+		var err error
+		if registered {
+			err = s.Heartbeat()
+		} else if err = s.Register(); err == nil {
+			registered = true
+		}
+		var statusErr *utils.StatusError
+		if errors.As(err, &statusErr) && statusErr.Code == http.StatusNotFound {
+			registered = false
+		}
+		if err != nil {
+			fmt.Printf("slave heartbeat failed, id: %s, error: %s\n", s.id, err.Error())
+		}
+		sleep(ctx, DefaultHeartbeatInterval)
+	}
+}
+
+// Register registers the slave with the master.
+func (s *Slave) Register() error {
+	b, _ := json.Marshal(SlaveRequest{ID: s.id, Capabilities: s.capabilities})
+	_, err := utils.DoPostRequest(s.master+slavesBasePath+"register", time.Second*5, bytes.NewBuffer(b))
+	return err
+}
+
+// Heartbeat tells the master the slave is alive, it fails with a 404
+// StatusError if the master doesn't know the slave.
+func (s *Slave) Heartbeat() error {
+	b, _ := json.Marshal(SlaveRequest{ID: s.id})
+	_, err := utils.DoPostRequest(s.master+slavesBasePath+"heartbeat", time.Second*5, bytes.NewBuffer(b))
+	return err
+}
+
+// Update leases a missed key from the master, fetches it and sends the value
+// back. empty reports whether the master had no key to refresh. The fetch is
+// aborted once ctx is done.
+func (s *Slave) Update(ctx context.Context) (empty bool, err error) {
+	g := s.group
+	if !g.available() {
+		fmt.Printf("every upstream is down, group: %s\n", g.name)
+		return false, utils.ErrBreakerOpen
+	}
+
+	api := s.master + defaultBasePath + url.PathEscape(g.name)
+	b, header, err := utils.DoGetRequestWithHeader(api+"?missed=1&slave="+url.QueryEscape(s.id), time.Second*5)
+	if err != nil {
+		fmt.Printf("request get missed failed, error: %s\n", err.Error())
+		return
+	}
+
+	key := string(b)
+	if key == "" {
+		fmt.Println("no missed")
+		empty = true
+		return
+	}
+
+	fetchedAt := time.Now()
+	lease := Lease{Key: key, Token: header.Get(leaseHeader)}
+	value, err := g.fetch(ctx, key)
+	if err != nil {
+		fmt.Printf("fetch failed, group: %s, key: %s, error: %s\n", g.name, key, err.Error())
+		// keys given up on stay leased until the lease expires
+		if ctx.Err() == nil {
+			_ = s.nack(api, newNack(lease, s.id, err))
+		}
+		return
+	}
+
+	err = s.send(api, UpdateCacheRequest{
+		Key:     key,
+		Value:   string(value),
+		Version: fetchedAt.UnixNano(),
+		Lease:   lease.Token,
+		Slave:   s.id,
+	})
+	return
+}
+
+// UpdateBatch leases a batch of missed keys from the master, fetches them at
+// once and sends each value back, see GroupWithBatch. empty reports whether
+// the master had no key to refresh.
+func (s *Slave) UpdateBatch(ctx context.Context) (empty bool, err error) {
+	g := s.group
+	if !g.available() {
+		fmt.Printf("every upstream is down, group: %s\n", g.name)
+		return false, utils.ErrBreakerOpen
+	}
+
+	api := s.master + defaultBasePath + url.PathEscape(g.name)
+	query := url.Values{}
+	query.Set("missed", "1")
+	query.Set("batch", strconv.Itoa(g.batchSymbols))
+	query.Set("slave", s.id)
+	b, header, err := utils.DoGetRequestWithHeader(api+"?"+query.Encode(), time.Second*5)
+	if err != nil {
+		fmt.Printf("request get missed failed, error: %s\n", err.Error())
+		return
+	}
+	var leases []Lease
+	if strings.HasPrefix(header.Get("Content-Type"), "application/json") {
+		if err = json.Unmarshal(b, &leases); err != nil {
+			return
+		}
+	} else if len(b) > 0 {
+		// masters without batches ignore the batch and lease a single key
+		leases = append(leases, Lease{Key: string(b), Token: header.Get(leaseHeader)})
+	}
+	if len(leases) == 0 {
+		fmt.Println("no missed")
+		return true, nil
+	}
+
+	fetchedAt := time.Now()
+	values, errs := g.fetchBatch(ctx, leaseKeys(leases))
+	for _, lease := range leases {
+		value, ok := values[lease.Key]
+		if !ok {
+			if ctx.Err() == nil {
+				_ = s.nack(api, newNack(lease, s.id, errs[lease.Key]))
+			}
+			continue
+		}
+		_ = s.send(api, UpdateCacheRequest{
+			Key:     lease.Key,
+			Value:   string(value),
+			Version: fetchedAt.UnixNano(),
+			Lease:   lease.Token,
+			Slave:   s.id,
+		})
+	}
+	if len(errs) > 0 {
+		err = fmt.Errorf("%d of %d keys failed", len(errs), len(leases))
+	}
+	return
+}
+
+// send posts an update to the master at api.
+func (s *Slave) send(api string, req UpdateCacheRequest) error {
+	b, _ := json.Marshal(req)
+	if _, err := utils.DoPostRequest(api, time.Second*5, bytes.NewBuffer(b)); err != nil {
+		fmt.Printf("request update cache failed, error: %s\n", err.Error())
+		return err
+	}
+	fmt.Printf("request update cache succeed, key: %s, value: %s\n", req.Key, req.Value)
+	return nil
+}
+
+// nack reports to the master at api that the slave failed to refresh a key.
+func (s *Slave) nack(api string, req NackRequest) error {
+	b, _ := json.Marshal(req)
+	if _, err := utils.DoPostRequest(api+"?nack=1", time.Second*5, bytes.NewBuffer(b)); err != nil {
+		fmt.Printf("request nack failed, error: %s\n", err.Error())
+		return err
+	}
+	return nil
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func postSlave(p *HTTPPool, action, id string) int {
+	b, _ := json.Marshal(SlaveRequest{ID: id, Capabilities: []string{Sina}})
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodPost, slavesBasePath+action, bytes.NewReader(b)))
+	return w.Code
+}
+
+func TestSlaveRegistry(t *testing.T) {
+	defer func(r *SlaveRegistry) { slaves = r }(slaves)
+	slaves = NewSlaveRegistry(time.Millisecond * 50)
+
+	g := NewGroup("slaves", 2<<10, GetterFunc(func(key string) ([]byte, error) { return nil, nil }))
+	p := NewHTTPPool("localhost")
+	if code := postSlave(p, "heartbeat", "s1"); code != http.StatusNotFound {
+		t.Fatalf("expect heartbeat of unknown slave to fail, but %d got", code)
+	}
+	if code := postSlave(p, "register", "s1"); code != http.StatusOK {
+		t.Fatalf("expect register to succeed, but %d got", code)
+	}
+	postSlave(p, "register", "s2")
+
+	g.SendMissedCache("a")
+	g.SendMissedCache("b")
+	a, _ := g.LeaseMissed("s1")
+	time.Sleep(time.Millisecond * 10)
+	postRequest(p, "slaves", UpdateCacheRequest{Key: a.Key, Value: "1", Lease: a.Token, Slave: "s1"})
+	if b, _ := g.LeaseMissed("s2"); b.Key != "b" {
+		t.Fatalf("expect b leased, but %+v got", b)
+	}
+
+	// s2 dies holding b
+	time.Sleep(time.Millisecond * 30)
+	postSlave(p, "heartbeat", "s1")
+	time.Sleep(time.Millisecond * 30)
+	postSlave(p, "heartbeat", "s1")
+	if b, _ := g.LeaseMissed("s1"); b.Key != "b" || b.Attempts != 1 {
+		t.Fatalf("expect the lease of a dead slave to be released, but %+v got", b)
+	}
+
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, adminSlavesPath, nil))
+	var stats []SlaveStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil || len(stats) != 2 {
+		t.Fatalf("unexpected slave stats %s, error: %v", w.Body.String(), err)
+	}
+	s1, s2 := stats[0], stats[1]
+	if !s1.Alive || s1.Fetched != 1 || s1.LatencyMs < 10 || s1.Capabilities[0] != Sina {
+		t.Fatalf("unexpected stats of s1 %+v", s1)
+	}
+	if s2.Alive {
+		t.Fatalf("expect s2 to be dead, but %+v got", s2)
+	}
+}
+
+func TestSlaveUpdate(t *testing.T) {
+	master := NewGroup("remote", 2<<10, GetterFunc(func(key string) ([]byte, error) { return nil, nil }),
+		GroupWithMode(ModeMaster))
+	server := httptest.NewServer(NewHTTPPool("localhost"))
+	defer server.Close()
+
+	if _, err := master.Get("key"); err == nil {
+		t.Fatal("expect a master to fail on misses")
+	}
+	// the slave's group shares the master's name, in its own process
+	local := &Group{name: "remote", getter: GetterFunc(func(key string) ([]byte, error) { return []byte("value"), nil })}
+	slave := NewSlave("s1", server.URL+"/", local, 1)
+	if err := slave.Register(); err != nil {
+		t.Fatalf("register failed, error: %s", err.Error())
+	}
+	if empty, err := slave.Update(context.Background()); empty || err != nil {
+		t.Fatalf("expect an update, but empty: %v, error: %v", empty, err)
+	}
+	if v, err := master.Get("key"); err != nil || v.String() != "value" || master.queue.Len() != 0 {
+		t.Fatalf("expect the slave's value to be cached and acknowledged, but %q, %v got", v, err)
+	}
+	if empty, _ := slave.Update(context.Background()); !empty {
+		t.Fatal("expect no key left")
+	}
+}
+
+func TestSlaveUpdateBatchFallback(t *testing.T) {
+	// a master without batches answers with a single key in text
+	var updates []UpdateCacheRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			var req UpdateCacheRequest
+			_ = json.NewDecoder(r.Body).Decode(&req)
+			updates = append(updates, req)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set(leaseHeader, "token")
+		_, _ = w.Write([]byte("key"))
+	}))
+	defer server.Close()
+
+	local := &Group{name: "legacy", getter: GetterFunc(func(key string) ([]byte, error) { return []byte("value"), nil }),
+		batchSymbols: 10}
+	slave := NewSlave("s1", server.URL, local, 1)
+	if empty, err := slave.UpdateBatch(context.Background()); empty || err != nil {
+		t.Fatalf("expect an update, but empty: %v, error: %v", empty, err)
+	}
+	if len(updates) != 1 || updates[0].Key != "key" || updates[0].Lease != "token" || updates[0].Value != "value" {
+		t.Fatalf("expect the single key updated with its lease, but %+v got", updates)
+	}
+}
@@ -0,0 +1,127 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"stock_data_cache/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const tencentQuoteApi = "http://qt.gtimg.cn/q="
+
+// TencentProvider fetches quotes from qt.gtimg.cn.
+type TencentProvider struct {
+	httpProvider
+}
+
+// NewTencentProvider create a new instance of TencentProvider
+func NewTencentProvider() *TencentProvider {
+	return &TencentProvider{httpProvider{
+		api: tencentQuoteApi,
+		headers: map[string]string{
+			"Referer": "https://gu.qq.com/",
+		},
+		charset: "gbk",
+	}}
+}
+
+// Name implements Provider
+func (p *TencentProvider) Name() string {
+	return Tencent
+}
+
+// Symbols implements Provider
+func (p *TencentProvider) Symbols(key string) ([]string, error) {
+	return splitSymbols(key)
+}
+
+// Fetch implements Provider
+func (p *TencentProvider) Fetch(ctx context.Context, symbols []string, timeout time.Duration) ([]byte, error) {
+	defer utils.TimeTrack(time.Now(), "TencentProvider.Fetch")
+	return p.get(ctx, strings.Join(symbols, ","), timeout)
+}
+
+// Validate implements Provider, unknown symbols come back as
+// v_pv_none_match="1";
+func (p *TencentProvider) Validate(b []byte) error {
+	if err := validatePayload(Tencent, b); err != nil {
+		return err
+	}
+	if bytes.Contains(b, []byte("v_pv_none_match")) {
+		return &PayloadError{Provider: Tencent, Kind: ErrEmpty, Detail: "no match"}
+	}
+	return validateAssignments(Tencent, b, "v_")
+}
+
+// Parse implements Provider, each line looks like
+// v_sh600000="1~name~600000~price~prev_close~open~volume~...~datetime~...";
+// with high, low and amount at fields 33, 34 and 37, where volume is in lots of 100 shares and amount is in units of 10,000 yuan.
+func (p *TencentProvider) Parse(b []byte) ([]Quote, error) {
+	quotes := make([]Quote, 0)
+	for _, line := range bytes.Split(b, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		symbol, content, err := splitAssignment(string(line), "v_")
+		if err != nil {
+			return nil, err
+		}
+		if content == "" {
+			continue
+		}
+		fields := strings.Split(content, "~")
+		if len(fields) < 38 {
+			return nil, fmt.Errorf("tencent quote %s has %d fields", symbol, len(fields))
+		}
+		q := Quote{Symbol: symbol, Name: fields[1]}
+		if err := parseFloats(fields, map[int]*float64{
+			3: &q.Price, 4: &q.PrevClose, 5: &q.Open, 6: &q.Volume, 33: &q.High, 34: &q.Low, 37: &q.Amount,
+		}); err != nil {
+			return nil, fmt.Errorf("tencent quote %s: %s", symbol, err.Error())
+		}
+		q.Volume *= 100
+		q.Amount *= 10000
+		if q.Time, err = time.ParseInLocation("20060102150405", fields[30], chinaZone); err != nil {
+			return nil, fmt.Errorf("tencent quote %s: %s", symbol, err.Error())
+		}
+		quotes = append(quotes, q)
+	}
+	return quotes, nil
+}
+
+// Split implements Splitter
+func (p *TencentProvider) Split(b []byte) (map[string][]byte, error) {
+	return splitLines(Tencent, b, "v_")
+}
+
+// Format implements Provider
+func (p *TencentProvider) Format(quotes []Quote) []byte {
+	var buf bytes.Buffer
+	for _, q := range quotes {
+		fields := make([]string, 50)
+		for i := range fields {
+			fields[i] = "0"
+		}
+		volume := strconv.FormatFloat(q.Volume/100, 'f', 0, 64)
+		amount := strconv.FormatFloat(q.Amount/10000, 'f', 4, 64)
+		fields[0] = "1"
+		fields[1] = q.Name
+		fields[2] = q.Symbol[2:]
+		fields[3] = formatPrice(q.Price)
+		fields[4] = formatPrice(q.PrevClose)
+		fields[5] = formatPrice(q.Open)
+		fields[6] = volume
+		fields[30] = q.Time.In(chinaZone).Format("20060102150405")
+		fields[33] = formatPrice(q.High)
+		fields[34] = formatPrice(q.Low)
+		fields[35] = strings.Join([]string{formatPrice(q.Price), volume, strconv.FormatFloat(q.Amount, 'f', 0, 64)}, "/")
+		fields[36] = volume
+		fields[37] = amount
+		fmt.Fprintf(&buf, "v_%s=\"%s\";\n", q.Symbol, strings.Join(fields, "~"))
+	}
+	return buf.Bytes()
+}
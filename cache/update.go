@@ -0,0 +1,107 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const DefaultWorkers = 8
+
+// A KeyResult is the outcome of refreshing one key.
+type KeyResult struct {
+	Key      string
+	Err      error
+	Duration time.Duration
+}
+
+// An UpdateResult is the outcome of refreshing a batch of keys.
+type UpdateResult struct {
+	Succeeded []KeyResult
+	Failed    []KeyResult
+	// Canceled keys were not refreshed, or not completely, because the
+	// context was done
+	Canceled []string
+	Elapsed  time.Duration
+}
+
+// Total returns the number of keys in the batch.
+func (r UpdateResult) Total() int {
+	return len(r.Succeeded) + len(r.Failed) + len(r.Canceled)
+}
+
+func (r UpdateResult) String() string {
+	return fmt.Sprintf("total: %d, succeed: %d, failed: %d, canceled: %d, elapsed: %s",
+		r.Total(), len(r.Succeeded), len(r.Failed), len(r.Canceled), r.Elapsed)
+}
+
+// GroupWithWorkers sets how many keys the group refreshes concurrently.
+func GroupWithWorkers(workers int) GroupOption {
+	return func(g *Group) {
+		g.workers = workers
+	}
+}
+
+// refresh fetches keys with a bounded pool of workers and populates the cache
+// with the results. Upstream requests still share their hosts' rate limits.
+// Once ctx is done running upstream requests are aborted, and keys aborted or
+// not started are reported as canceled.
+func (g *Group) refresh(ctx context.Context, keys []string) UpdateResult {
+	start := time.Now()
+	workers := g.workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	keyChan := make(chan string)
+	resultChan := make(chan KeyResult, len(keys))
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keyChan {
+				begin := time.Now()
+				v, err := g.fetch(ctx, key)
+				if err == nil {
+					err = g.populateCache(key, ByteView{b: cloneBytes(v)}, begin.UnixNano())
+				}
+				resultChan <- KeyResult{Key: key, Err: err, Duration: time.Since(begin)}
+			}
+		}()
+	}
+
+	sent := 0
+feed:
+	for _, key := range keys {
+		if ctx.Err() != nil {
+			break
+		}
+		select {
+		case keyChan <- key:
+			sent++
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(keyChan)
+	wg.Wait()
+	close(resultChan)
+
+	var result UpdateResult
+	for r := range resultChan {
+		if r.Err != nil && ctx.Err() != nil && errors.Is(r.Err, ctx.Err()) {
+			result.Canceled = append(result.Canceled, r.Key)
+		} else if r.Err != nil {
+			fmt.Printf("fetch failed, group: %s, key: %s, error: %s\n", g.name, r.Key, r.Err.Error())
+			result.Failed = append(result.Failed, r)
+		} else {
+			result.Succeeded = append(result.Succeeded, r)
+		}
+	}
+	result.Canceled = append(result.Canceled, keys[sent:]...)
+	result.Elapsed = time.Since(start)
+	return result
+}
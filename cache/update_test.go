@@ -0,0 +1,51 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUpdateCache(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	g := NewGroup("update", 2<<10, GetterFunc(func(key string) ([]byte, error) {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		time.Sleep(time.Millisecond * 10)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		if key == "k0" {
+			return nil, errors.New("upstream failed")
+		}
+		return []byte("new " + key), nil
+	}), GroupWithWorkers(4))
+	for i := 0; i < 20; i++ {
+		_ = g.populateCache(fmt.Sprintf("k%d", i), ByteView{b: []byte("old")}, 1)
+	}
+
+	result := g.UpdateCache(context.Background(), 100, 0)
+	if result.Total() != 20 || len(result.Succeeded) != 19 || len(result.Failed) != 1 || result.Failed[0].Key != "k0" {
+		t.Fatalf("unexpected result: %s", result)
+	}
+	if maxRunning > 4 {
+		t.Fatalf("expect at most 4 concurrent fetches, but %d got", maxRunning)
+	}
+	if v, _, _ := g.mainCache.get("k1"); v.String() != "new k1" {
+		t.Fatalf("expect k1 to be refreshed, but %s got", v)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if result := g.UpdateCache(ctx, 100, 0); len(result.Canceled) != 20 {
+		t.Fatalf("expect every key to be canceled, but %s", result)
+	}
+}
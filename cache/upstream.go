@@ -0,0 +1,171 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"stock_data_cache/utils"
+	"sync"
+	"time"
+)
+
+// UpstreamConfig configures how upstream hosts are requested.
+type UpstreamConfig struct {
+	Retry utils.RetryPolicy
+	// Rate is the number of requests per second allowed to a host
+	Rate float64
+	// Burst is the number of requests allowed to a host at once
+	Burst int
+	// BreakerThreshold is the number of consecutive failures opening a host's breaker
+	BreakerThreshold int
+	// BreakerCooldown is how long an open breaker rejects requests
+	BreakerCooldown time.Duration
+}
+
+var DefaultUpstreamConfig = UpstreamConfig{
+	Retry:            utils.DefaultRetryPolicy,
+	Rate:             10,
+	Burst:            5,
+	BreakerThreshold: 5,
+	BreakerCooldown:  time.Second * 30,
+}
+
+// upstream holds the state shared by every request to one host.
+type upstream struct {
+	host    string
+	retry   utils.RetryPolicy
+	limiter *utils.Limiter
+	breaker *utils.Breaker
+}
+
+var (
+	upstreamsMu    sync.Mutex
+	upstreamConfig = DefaultUpstreamConfig
+	upstreams      = make(map[string]*upstream)
+)
+
+// ConfigureUpstreams sets the config of upstream hosts, resetting their state.
+func ConfigureUpstreams(config UpstreamConfig) {
+	upstreamsMu.Lock()
+	defer upstreamsMu.Unlock()
+	upstreamConfig = config
+	upstreams = make(map[string]*upstream)
+}
+
+func getUpstream(host string) *upstream {
+	upstreamsMu.Lock()
+	defer upstreamsMu.Unlock()
+	u, ok := upstreams[host]
+	if !ok {
+		u = &upstream{
+			host:    host,
+			retry:   upstreamConfig.Retry,
+			limiter: utils.NewLimiter(upstreamConfig.Rate, upstreamConfig.Burst),
+			breaker: utils.NewBreaker(upstreamConfig.BreakerThreshold, upstreamConfig.BreakerCooldown),
+		}
+		upstreams[host] = u
+	}
+	return u
+}
+
+// adapt slows requests to the host down when it throttles us, and speeds
+// them back up when it doesn't.
+func (u *upstream) adapt(err error) {
+	var statusErr *utils.StatusError
+	switch {
+	case err == nil:
+		u.limiter.Succeeded()
+	case errors.As(err, &statusErr) && (statusErr.Code == http.StatusForbidden || statusErr.Code == http.StatusTooManyRequests):
+		fmt.Printf("upstream throttled, host: %s, status code: %d\n", u.host, statusErr.Code)
+		u.limiter.Throttled()
+	}
+}
+
+// unhealthy reports whether err says the host is unhealthy: client errors
+// other than throttling and blocking (403) say nothing about its health.
+func (u *upstream) unhealthy(err error) bool {
+	var statusErr *utils.StatusError
+	if err == nil {
+		return false
+	}
+	if errors.As(err, &statusErr) && !utils.IsRetryable(err) {
+		return statusErr.Code == http.StatusForbidden
+	}
+	return true
+}
+
+// hostOf returns the host of rawURL, or rawURL itself if it can't be parsed.
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	return u.Host
+}
+
+// Available reports whether the host's circuit breaker lets requests through.
+func Available(host string) bool {
+	return getUpstream(host).breaker.State() != utils.BreakerOpen
+}
+
+// fetch requests rawURL with headers and decodes the body to UTF-8 from the
+// charset its Content-Type declares, or from charset if it declares none.
+// Requests to a host share its rate limit, retryable errors are retried with
+// backoff, and requests fail fast while the host's circuit breaker is open.
+// Requests, retries and waits for the rate limit are aborted once ctx is done.
+func fetch(ctx context.Context, rawURL string, headers map[string]string, charset string, timeout time.Duration) ([]byte, error) {
+	u := getUpstream(hostOf(rawURL))
+	opts := []utils.RequestOption{utils.RequestWithHeaders(headers)}
+
+	var b []byte
+	var header http.Header
+	attempt := 0
+	err := utils.RetryWithContext(ctx, u.retry, func() (err error) {
+		if err = u.breaker.Allow(); err != nil {
+			return err
+		}
+		if err = u.limiter.Wait(ctx); err != nil {
+			// no request was sent, a half-open breaker must let another probe
+			// through
+			u.breaker.Abort()
+			return err
+		}
+		if attempt++; attempt > 1 {
+			metrics.Inc("upstream_retries_total", "host", u.host)
+		}
+		b, header, err = utils.DoGetRequestWithContext(ctx, rawURL, timeout, opts...)
+		if ctx.Err() != nil {
+			// aborted, which says nothing about the host, but a half-open
+			// breaker must let another probe through
+			u.breaker.Abort()
+			return ctx.Err()
+		}
+		u.adapt(err)
+		// a blocked page served with status 200 is a failure too, validatePayload
+		// rejects it
+		blocked := err == nil && blockedPage(bytes.TrimSpace(b))
+		if blocked {
+			fmt.Printf("upstream blocked, host: %s\n", u.host)
+			u.limiter.Throttled()
+		}
+		if blocked || u.unhealthy(err) {
+			u.breaker.Failure()
+		} else {
+			u.breaker.Success()
+		}
+		return err
+	})
+	metrics.Set("upstream_rate", u.limiter.Rate(), "host", u.host)
+	if state := u.breaker.State(); state == utils.BreakerOpen {
+		metrics.Set("upstream_breaker_open", 1, "host", u.host)
+	} else {
+		metrics.Set("upstream_breaker_open", 0, "host", u.host)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", u.host, err)
+	}
+	return utils.Decode(b, utils.ResponseCharset(header.Get("Content-Type"), charset))
+}
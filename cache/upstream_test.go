@@ -0,0 +1,233 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"github.com/axgle/mahonia"
+	"net/http"
+	"net/http/httptest"
+	"stock_data_cache/utils"
+	"testing"
+	"time"
+)
+
+func TestFetchRetry(t *testing.T) {
+	ConfigureUpstreams(UpstreamConfig{
+		Retry:            utils.RetryPolicy{Attempts: 3, BaseDelay: time.Millisecond},
+		BreakerThreshold: 100,
+	})
+	defer ConfigureUpstreams(DefaultUpstreamConfig)
+
+	statuses := []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(statuses[requests%len(statuses)])
+		requests++
+	}))
+	defer srv.Close()
+
+	if _, err := fetch(context.Background(), srv.URL, nil, "", time.Second); err != nil || requests != 3 {
+		t.Fatalf("expect success after 3 requests, but %d requests, error: %v", requests, err)
+	}
+
+	statuses = []int{http.StatusNotFound}
+	requests = 0
+	var statusErr *utils.StatusError
+	if _, err := fetch(context.Background(), srv.URL, nil, "", time.Second); !errors.As(err, &statusErr) || requests != 1 {
+		t.Fatalf("expect 404 not to be retried, but %d requests, error: %v", requests, err)
+	}
+}
+
+func TestFetchBreaker(t *testing.T) {
+	ConfigureUpstreams(UpstreamConfig{
+		Retry:            utils.RetryPolicy{Attempts: 1},
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Millisecond * 50,
+	})
+	defer ConfigureUpstreams(DefaultUpstreamConfig)
+
+	status := http.StatusBadGateway
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	for i := 0; i < 2; i++ {
+		_, _ = fetch(context.Background(), srv.URL, nil, "", time.Second)
+	}
+	if _, err := fetch(context.Background(), srv.URL, nil, "", time.Second); !errors.Is(err, utils.ErrBreakerOpen) || requests != 2 {
+		t.Fatalf("expect open breaker to reject requests, but %d requests, error: %v", requests, err)
+	}
+	if Available(hostOf(srv.URL)) {
+		t.Fatal("expect host to be unavailable")
+	}
+
+	time.Sleep(time.Millisecond * 60)
+	status = http.StatusOK
+	if _, err := fetch(context.Background(), srv.URL, nil, "", time.Second); err != nil || requests != 3 {
+		t.Fatalf("expect probe to close breaker, but %d requests, error: %v", requests, err)
+	}
+	if !Available(hostOf(srv.URL)) {
+		t.Fatal("expect host to be available")
+	}
+}
+
+func TestFetchBreakerBlocked(t *testing.T) {
+	ConfigureUpstreams(UpstreamConfig{
+		Retry:            utils.RetryPolicy{Attempts: 1},
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Minute,
+	})
+	defer ConfigureUpstreams(DefaultUpstreamConfig)
+
+	for _, blocked := range []func(w http.ResponseWriter){
+		func(w http.ResponseWriter) { w.WriteHeader(http.StatusForbidden) },
+		func(w http.ResponseWriter) { _, _ = w.Write([]byte("<html>captcha</html>")) },
+	} {
+		blocked := blocked
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { blocked(w) }))
+		for i := 0; i < 2; i++ {
+			_, _ = fetch(context.Background(), srv.URL, nil, "", time.Second)
+		}
+		if Available(hostOf(srv.URL)) {
+			t.Fatal("expect a host blocking us to open its breaker")
+		}
+		srv.Close()
+	}
+}
+
+func TestFetchCancel(t *testing.T) {
+	defer ConfigureUpstreams(DefaultUpstreamConfig)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-r.Context().Done()
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	// a running request, a retry's backoff and a wait for the rate limit are
+	// all aborted
+	retry := utils.RetryPolicy{Attempts: 3, BaseDelay: time.Second}
+	cases := []struct {
+		path   string
+		config UpstreamConfig
+	}{
+		{"/slow", UpstreamConfig{Retry: retry, BreakerThreshold: 1}},
+		{"/failing", UpstreamConfig{Retry: retry, BreakerThreshold: 2}},
+		{"/limited", UpstreamConfig{Retry: retry, Rate: 0.1, Burst: 1, BreakerThreshold: 1}},
+	}
+	for _, c := range cases {
+		ConfigureUpstreams(c.config)
+		if c.path == "/limited" {
+			_ = getUpstream(hostOf(srv.URL)).limiter.Wait(context.Background())
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+		start := time.Now()
+		_, err := fetch(ctx, srv.URL+c.path, nil, "", time.Second*5)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > time.Millisecond*500 {
+			t.Fatalf("expect %s to be aborted, but error: %v after %s", c.path, err, time.Since(start))
+		}
+		if !Available(hostOf(srv.URL)) {
+			t.Fatalf("expect aborting %s not to open the breaker", c.path)
+		}
+	}
+}
+
+func TestFetchCancelProbe(t *testing.T) {
+	ConfigureUpstreams(UpstreamConfig{Retry: utils.RetryPolicy{Attempts: 1}, Rate: 0.1, Burst: 1,
+		BreakerThreshold: 1, BreakerCooldown: time.Millisecond * 10})
+	defer ConfigureUpstreams(DefaultUpstreamConfig)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer srv.Close()
+
+	// the failure opens the breaker and takes the only token
+	_, _ = fetch(context.Background(), srv.URL, nil, "", time.Second)
+	time.Sleep(time.Millisecond * 20)
+	u := getUpstream(hostOf(srv.URL))
+	if state := u.breaker.State(); state != utils.BreakerHalfOpen {
+		t.Fatalf("expect a half-open breaker, but %s got", state)
+	}
+	// the probe is let through, then cancelled while waiting for a token
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+	if _, err := fetch(ctx, srv.URL, nil, "", time.Second); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expect the wait for a token to be aborted, but %v got", err)
+	}
+	if err := u.breaker.Allow(); err != nil {
+		t.Fatalf("expect another probe to be let through, but %v got", err)
+	}
+}
+
+func TestFetchRateLimit(t *testing.T) {
+	ConfigureUpstreams(UpstreamConfig{Retry: utils.RetryPolicy{Attempts: 1}, Rate: 100, Burst: 1, BreakerThreshold: 100})
+	defer ConfigureUpstreams(DefaultUpstreamConfig)
+
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		_, _ = fetch(context.Background(), srv.URL, nil, "", time.Second)
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*45 {
+		t.Fatalf("expect 5 requests to wait for tokens, but took %s", elapsed)
+	}
+
+	host := hostOf(srv.URL)
+	status = http.StatusForbidden
+	_, _ = fetch(context.Background(), srv.URL, nil, "", time.Second)
+	if rate := metrics.Get("upstream_rate", "host", host); rate != 50 {
+		t.Fatalf("expect rate to be halved after 403, but %g got", rate)
+	}
+	status = http.StatusOK
+	_, _ = fetch(context.Background(), srv.URL, nil, "", time.Second)
+	if rate := metrics.Get("upstream_rate", "host", host); rate != 60 {
+		t.Fatalf("expect rate to recover after success, but %g got", rate)
+	}
+}
+
+func TestFetchCharset(t *testing.T) {
+	gbk := mahonia.NewEncoder("gbk").ConvertString("平安银行")
+	gb18030 := mahonia.NewEncoder("gb18030").ConvertString("平安银行")
+	cases := []struct {
+		contentType string
+		body        string
+		fallback    string
+	}{
+		{"text/html", gbk, "gbk"},
+		{"application/javascript; charset=GBK", gbk, "utf-8"},
+		{"text/plain; charset=gb2312", gbk, ""},
+		{"text/plain; charset=GB18030", gb18030, "gbk"},
+		{"application/json", "平安银行", "gbk"},
+		{"application/json; charset=utf-8", "平安银行", "gbk"},
+		{"", "平安银行", "utf-8"},
+	}
+
+	var contentType, body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	for _, c := range cases {
+		contentType, body = c.contentType, c.body
+		b, err := fetch(context.Background(), srv.URL, nil, c.fallback, time.Second)
+		if err != nil || string(b) != "平安银行" {
+			t.Fatalf("Content-Type %q with fallback %q: expect 平安银行, but %q got, error: %v",
+				c.contentType, c.fallback, b, err)
+		}
+	}
+}
@@ -1,56 +1,212 @@
 package main
 
 import (
-	"errors"
-	"fmt"
+	"context"
+	"flag"
 	"log"
+	"net"
 	"net/http"
+	"os"
 	"stock_data_cache/cache"
+	"stock_data_cache/pb"
+	"stock_data_cache/utils"
+	"strings"
 	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
 )
 
 func main() {
-	cache.NewGroup(cache.Sina, 2<<26, cache.GetterFunc(
-		func(key string) ([]byte, error) {
-			log.Println("request sina", key)
-			v, err := cache.RequestSina(key, time.Second*5)
-			if err != nil {
-				msg := fmt.Sprintf("request sina failed, error: %s", err.Error())
-				fmt.Println(msg)
-				return nil, errors.New(msg)
-			}
-			return []byte(v), nil
-		}))
-	g := cache.GetGroup(cache.Sina)
-	g.LoadCache()
-	go func() {
-		for {
-			select {
-			case <-time.After(time.Hour):
-				g.SaveCache()
+	hostname, _ := os.Hostname()
+	modeName := flag.String("mode", string(cache.ModeStandalone), "master serves and queues missed keys for slaves, slave refreshes them, standalone does both")
+	addr := flag.String("addr", "0.0.0.0:7296", "address to listen on")
+	master := flag.String("master", "http://api.gushenpai.com:7295", "base URL of the master, in slave mode")
+	grpcAddr := flag.String("grpc-addr", "", "address to serve slaves over gRPC on, e.g. 0.0.0.0:7297, off if empty")
+	grpcMaster := flag.String("grpc-master", "", "gRPC address of the master, e.g. 10.0.0.1:7297, in slave mode instead of -master")
+	id := flag.String("id", hostname, "identity of the slave, in slave mode")
+	self := flag.String("self", "", "base URL of this node among -peers and -masters, e.g. http://10.0.0.1:7296")
+	peerList := flag.String("peers", "", "comma separated base URLs of the cache nodes sharing keys, self included")
+	masters := flag.String("masters", "", "comma separated base URLs of the masters electing a leader, self included")
+	primary := flag.String("primary", "", "base URL of the primary to replicate, this node is a replica until promoted")
+	replicas := flag.Int("replicas", 50, "virtual nodes of each peer on the hash ring")
+	providerName := flag.String("provider", cache.Sina, "upstream provider of the sina group: sina, tencent or eastmoney")
+	failover := flag.String("failover", "tencent,eastmoney", "comma separated providers to fall back to, in order")
+	workers := flag.Int("workers", cache.DefaultWorkers, "keys refreshed concurrently, also by slaves and standalone workers")
+	batch := flag.Int("batch", cache.DefaultBatchSymbols, "symbols fetched in one upstream request, 1 fetches a key at a time")
+	batchWindow := flag.Duration("batch-window", cache.DefaultBatchWindow, "how long workers gather queued keys for a batch")
+	sessionTTL := flag.Duration("session-ttl", cache.DefaultSessionTTL, "expiry of quotes fetched while their market is open")
+	holidays := flag.String("holidays", "", "json file of market holidays, overriding the built-in ones")
+	rate := flag.Float64("rate", cache.DefaultUpstreamConfig.Rate, "requests per second allowed to each upstream host")
+	burst := flag.Int("burst", cache.DefaultUpstreamConfig.Burst, "requests allowed to each upstream host at once")
+	retries := flag.Int("retries", utils.DefaultRetryPolicy.Attempts, "maximum attempts of an upstream request")
+	breakerThreshold := flag.Int("breaker-threshold", cache.DefaultUpstreamConfig.BreakerThreshold, "consecutive failures opening an upstream host's circuit breaker")
+	queueFile := flag.String("queue-file", cache.QueueFilePath, "append-only file keeping the keys waiting to be refreshed across restarts, off if empty")
+	queueSync := flag.Duration("queue-sync", cache.DefaultQueueConfig.SyncInterval, "how long changes to -queue-file may wait to be synced to disk, 0 syncs each change, negative leaves it to the OS")
+	staleWeight := flag.Int("stale-weight", cache.DefaultQueueConfig.StaleWeight, "share of refreshes given to expired keys clients read")
+	backgroundWeight := flag.Int("background-weight", cache.DefaultQueueConfig.BackgroundWeight, "share of refreshes given to expired keys found in the background")
+	breakerCooldown := flag.Duration("breaker-cooldown", cache.DefaultUpstreamConfig.BreakerCooldown, "how long an open circuit breaker rejects requests")
+	flag.Parse()
+
+	mode, err := cache.ParseMode(*modeName)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	upstreamConfig := cache.DefaultUpstreamConfig
+	upstreamConfig.Rate = *rate
+	upstreamConfig.Burst = *burst
+	upstreamConfig.Retry.Attempts = *retries
+	upstreamConfig.BreakerThreshold = *breakerThreshold
+	upstreamConfig.BreakerCooldown = *breakerCooldown
+	cache.ConfigureUpstreams(upstreamConfig)
+
+	queueConfig := cache.DefaultQueueConfig
+	queueConfig.StaleWeight = *staleWeight
+	queueConfig.BackgroundWeight = *backgroundWeight
+	queueConfig.SyncInterval = *queueSync
+
+	provider := cache.GetProvider(*providerName)
+	if provider == nil {
+		log.Fatalf("no such provider: %s", *providerName)
+	}
+	fallbacks := make([]cache.Provider, 0)
+	for _, name := range strings.Split(*failover, ",") {
+		if name == "" || name == *providerName {
+			continue
+		}
+		p := cache.GetProvider(name)
+		if p == nil {
+			log.Fatalf("no such provider: %s", name)
+		}
+		fallbacks = append(fallbacks, p)
+	}
+	calendar := cache.NewCalendar(*sessionTTL)
+	if *holidays != "" {
+		if err := calendar.LoadHolidays(*holidays); err != nil {
+			log.Fatalf("load holidays failed, error: %s", err.Error())
+		}
+	}
+	g := cache.NewGroup(cache.Sina, 2<<26, nil, cache.GroupWithProvider(provider), cache.GroupWithFailover(fallbacks...),
+		cache.GroupWithWorkers(*workers), cache.GroupWithCalendar(calendar), cache.GroupWithQueue(queueConfig),
+		cache.GroupWithMode(mode), cache.GroupWithBatch(*batch, *batchWindow))
+	cache.NewKLineGroup(cache.KLine, 2<<24, cache.NewSinaProvider(), calendar)
+
+	var election *cache.Election
+	if *masters != "" && mode != cache.ModeSlave {
+		electionConfig := cache.DefaultElectionConfig
+		electionConfig.ID = *self
+		found := false
+		for _, master := range strings.Split(*masters, ",") {
+			if master == *self {
+				found = true
+				continue
 			}
+			electionConfig.Peers = append(electionConfig.Peers, master)
+		}
+		if !found {
+			log.Fatalf("-self %q is not one of -masters", *self)
+		}
+		if *primary != "" {
+			log.Fatal("-primary can't be set with -masters, followers replicate from the leader")
 		}
-	}()
-	go func() {
-		for {
-			select {
-			case <-time.After(time.Minute * 10):
-				g.SendTimeoutCache(100)
+		election = cache.NewElection(electionConfig, cache.NewHTTPTransport(electionConfig.HeartbeatInterval))
+		cache.FollowLeader(election, cache.DefaultPullInterval)
+		go election.Run(context.Background())
+	}
+	// only the leader of the masters runs the scheduled jobs
+	leading := func() bool {
+		return election == nil || election.IsLeader()
+	}
+
+	if mode == cache.ModeSlave {
+		// slaves only refresh the master's keys, they serve their metrics
+		slave := cache.NewSlave(*id, *master, g, *workers)
+		if *grpcMaster != "" {
+			conn, err := grpc.Dial(*grpcMaster, grpc.WithTransportCredentials(insecure.NewCredentials()),
+				grpc.WithKeepaliveParams(keepalive.ClientParameters{Time: cache.DefaultHeartbeatInterval, Timeout: cache.DefaultHeartbeatInterval}))
+			if err != nil {
+				log.Fatalf("dial %s failed, error: %s", *grpcMaster, err.Error())
 			}
+			go slave.RunStream(context.Background(), conn)
+		} else {
+			go slave.Run(context.Background())
 		}
-	}()
-	go func() {
-		for {
-			<-time.After(time.Second)
-			empty, _ := g.RemoteUpdateCache()
-			if empty {
-				<-time.After(time.Second * 10)
+	} else {
+		g.LoadCache()
+		if *queueFile != "" {
+			g.LoadQueue(*queueFile)
+			go func() {
+				for {
+					select {
+					case <-time.After(time.Minute * 10):
+						g.CompactQueue()
+					}
+				}
+			}()
+		}
+		go func() {
+			for {
+				select {
+				case <-time.After(time.Hour):
+					if leading() {
+						g.SaveCache()
+					}
+				}
+			}
+		}()
+		go func() {
+			for {
+				// quotes expire every session ttl while markets are open
+				interval := time.Minute * 10
+				if calendar.AnyOpen(time.Now()) {
+					interval = *sessionTTL
+				}
+				select {
+				case <-time.After(interval):
+					// replicas get fresh quotes from their primary
+					if cache.Role() == cache.RolePrimary && leading() {
+						g.SendTimeoutCache(100)
+					}
+				}
 			}
+		}()
+	}
+	if *primary != "" && mode != cache.ModeSlave {
+		cache.StartReplica(*primary, cache.DefaultPullInterval)
+	}
+	if *grpcAddr != "" && mode != cache.ModeSlave {
+		lis, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			log.Fatalf("listen %s failed, error: %s", *grpcAddr, err.Error())
 		}
-	}()
+		// dead slaves' streams break within a heartbeat timeout
+		server := grpc.NewServer(
+			grpc.KeepaliveParams(keepalive.ServerParameters{Time: cache.DefaultHeartbeatInterval, Timeout: cache.DefaultHeartbeatInterval}),
+			grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{MinTime: cache.DefaultHeartbeatInterval / 2, PermitWithoutStream: true}))
+		pb.RegisterWorkServer(server, cache.NewWorkServer(cache.WorkServerWithElection(election)))
+		go func() {
+			log.Fatal(server.Serve(lis))
+		}()
+	}
+	if mode == cache.ModeStandalone {
+		go g.RunWorkers(context.Background(), *workers)
+	}
 
-	addr := "0.0.0.0:7296"
-	peers := cache.NewHTTPPool(addr)
-	log.Println("server is running at", addr)
-	log.Fatal(http.ListenAndServe(addr, peers))
+	peers := cache.NewHTTPPool(*self, cache.HTTPPoolWithReplicas(*replicas), cache.HTTPPoolWithElection(election))
+	if *peerList != "" && mode != cache.ModeSlave {
+		list := strings.Split(*peerList, ",")
+		found := false
+		for _, peer := range list {
+			found = found || peer == *self
+		}
+		if !found {
+			log.Fatalf("-self %q is not one of -peers", *self)
+		}
+		peers.Set(list...)
+		g.RegisterPeers(peers)
+	}
+	log.Printf("%s is running at %s", mode, *addr)
+	log.Fatal(http.ListenAndServe(*addr, peers))
 }
@@ -0,0 +1,5 @@
+// Package pb holds the gRPC service masters distribute missed keys to slaves
+// with, generated from work.proto.
+package pb
+
+//go:generate protoc -I.. --go_out=.. --go_opt=paths=source_relative --go-grpc_out=.. --go-grpc_opt=paths=source_relative ../pb/work.proto
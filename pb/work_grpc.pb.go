@@ -0,0 +1,151 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: pb/work.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Work_Refresh_FullMethodName = "/stock_data_cache.Work/Refresh"
+)
+
+// WorkClient is the client API for Work service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type WorkClient interface {
+	// Refresh streams the keys a master leases to a slave, and the slave's
+	// results back. The slave opens the stream with a Hello, the master then
+	// leases it up to its credit of keys at once: each result returns a credit
+	// and Credit grants more. The master cancels assignments whose lease is
+	// over, and releases the slave's leases once the stream ends.
+	Refresh(ctx context.Context, opts ...grpc.CallOption) (Work_RefreshClient, error)
+}
+
+type workClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewWorkClient(cc grpc.ClientConnInterface) WorkClient {
+	return &workClient{cc}
+}
+
+func (c *workClient) Refresh(ctx context.Context, opts ...grpc.CallOption) (Work_RefreshClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Work_ServiceDesc.Streams[0], Work_Refresh_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &workRefreshClient{stream}
+	return x, nil
+}
+
+type Work_RefreshClient interface {
+	Send(*SlaveMessage) error
+	Recv() (*MasterMessage, error)
+	grpc.ClientStream
+}
+
+type workRefreshClient struct {
+	grpc.ClientStream
+}
+
+func (x *workRefreshClient) Send(m *SlaveMessage) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *workRefreshClient) Recv() (*MasterMessage, error) {
+	m := new(MasterMessage)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// WorkServer is the server API for Work service.
+// All implementations must embed UnimplementedWorkServer
+// for forward compatibility
+type WorkServer interface {
+	// Refresh streams the keys a master leases to a slave, and the slave's
+	// results back. The slave opens the stream with a Hello, the master then
+	// leases it up to its credit of keys at once: each result returns a credit
+	// and Credit grants more. The master cancels assignments whose lease is
+	// over, and releases the slave's leases once the stream ends.
+	Refresh(Work_RefreshServer) error
+	mustEmbedUnimplementedWorkServer()
+}
+
+// UnimplementedWorkServer must be embedded to have forward compatible implementations.
+type UnimplementedWorkServer struct {
+}
+
+func (UnimplementedWorkServer) Refresh(Work_RefreshServer) error {
+	return status.Errorf(codes.Unimplemented, "method Refresh not implemented")
+}
+func (UnimplementedWorkServer) mustEmbedUnimplementedWorkServer() {}
+
+// UnsafeWorkServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to WorkServer will
+// result in compilation errors.
+type UnsafeWorkServer interface {
+	mustEmbedUnimplementedWorkServer()
+}
+
+func RegisterWorkServer(s grpc.ServiceRegistrar, srv WorkServer) {
+	s.RegisterService(&Work_ServiceDesc, srv)
+}
+
+func _Work_Refresh_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(WorkServer).Refresh(&workRefreshServer{stream})
+}
+
+type Work_RefreshServer interface {
+	Send(*MasterMessage) error
+	Recv() (*SlaveMessage, error)
+	grpc.ServerStream
+}
+
+type workRefreshServer struct {
+	grpc.ServerStream
+}
+
+func (x *workRefreshServer) Send(m *MasterMessage) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *workRefreshServer) Recv() (*SlaveMessage, error) {
+	m := new(SlaveMessage)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Work_ServiceDesc is the grpc.ServiceDesc for Work service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Work_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "stock_data_cache.Work",
+	HandlerType: (*WorkServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Refresh",
+			Handler:       _Work_Refresh_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "pb/work.proto",
+}
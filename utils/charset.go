@@ -0,0 +1,40 @@
+package utils
+
+import (
+	"fmt"
+	"github.com/axgle/mahonia"
+	"mime"
+	"strings"
+)
+
+// ResponseCharset returns the charset of a response body with the given
+// Content-Type: its charset parameter, utf-8 for JSON which has no other
+// encoding, or fallback if the header says nothing.
+func ResponseCharset(contentType, fallback string) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fallback
+	}
+	if charset, ok := params["charset"]; ok && charset != "" {
+		return strings.ToLower(charset)
+	}
+	if mediaType == "application/json" || strings.HasSuffix(mediaType, "+json") {
+		return "utf-8"
+	}
+	return fallback
+}
+
+// Decode converts b from charset to UTF-8. Supported charsets are utf-8,
+// gbk and gb18030; gb2312 is decoded as its superset gbk.
+func Decode(b []byte, charset string) ([]byte, error) {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8":
+		return b, nil
+	case "gbk", "gb2312", "cp936":
+		charset = "gbk"
+	case "gb18030":
+	default:
+		return nil, fmt.Errorf("unsupported charset: %s", charset)
+	}
+	return []byte(mahonia.NewDecoder(charset).ConvertString(string(b))), nil
+}
@@ -1,21 +1,54 @@
 package utils
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 )
 
+// snapshotMagic starts every snapshot file, plain gob files never start
+// with it.
+var snapshotMagic = [8]byte{'S', 'D', 'C', 'S', 'N', 'A', 'P', 0}
+
+// snapshotHeaderSize is the size of the magic and the SnapshotHeader.
+const snapshotHeaderSize = 8 + 4 + 8 + 8 + 4
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// ErrNotSnapshot is a file without the snapshot header, e.g. one written
+	// by Save before snapshots had one
+	ErrNotSnapshot = errors.New("not a snapshot")
+	// ErrChecksum is a snapshot whose payload doesn't match its checksum,
+	// e.g. one cut off by a crash
+	ErrChecksum = errors.New("snapshot checksum mismatch")
+)
+
+// SnapshotHeader describes the payload of a snapshot file: the version of
+// its format, the number of entries in it, its length and CRC-32C.
+type SnapshotHeader struct {
+	Version  uint32
+	Count    uint64
+	Length   uint64
+	Checksum uint32
+}
+
+// Save writes object to the file at path as gob, see WriteFileAtomic.
 func Save(path string, object interface{}) error {
-	file, err := os.Create(path)
-	if err != nil {
-		return err
-	}
-	defer func(file *os.File) {
-		_ = file.Close()
-	}(file)
-	return gob.NewEncoder(file).Encode(object)
+	return WriteFileAtomic(path, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(object)
+	})
 }
 
+// Load reads the gob object of the file at path.
 func Load(path string, object interface{}) error {
 	file, err := os.Open(path)
 	if err != nil {
@@ -26,3 +59,102 @@ func Load(path string, object interface{}) error {
 	}(file)
 	return gob.NewDecoder(file).Decode(object)
 }
+
+// WriteFileAtomic replaces the file at path with what write writes: it is
+// written to a temporary file, synced and renamed over path, and the rename
+// is synced too, so a crash leaves either the old file or the new one.
+func WriteFileAtomic(path string, write func(w io.Writer) error) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(file)
+	err = write(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return SyncDir(path)
+}
+
+// SyncDir syncs the directory of the file at path, so that a file created or
+// renamed there survives a crash.
+func SyncDir(path string) error {
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// SaveSnapshot writes object to the file at path as gob, after a header with
+// the format version and count entries, atomically, see WriteFileAtomic.
+func SaveSnapshot(path string, version uint32, count int, object interface{}) error {
+	var payload bytes.Buffer
+	if err := gob.NewEncoder(&payload).Encode(object); err != nil {
+		return err
+	}
+	header := SnapshotHeader{
+		Version:  version,
+		Count:    uint64(count),
+		Length:   uint64(payload.Len()),
+		Checksum: crc32.Checksum(payload.Bytes(), crcTable),
+	}
+	return WriteFileAtomic(path, func(w io.Writer) error {
+		if _, err := w.Write(snapshotMagic[:]); err != nil {
+			return err
+		}
+		if err := binary.Write(w, binary.BigEndian, header); err != nil {
+			return err
+		}
+		_, err := w.Write(payload.Bytes())
+		return err
+	})
+}
+
+// LoadSnapshot reads the snapshot file at path after checking its length and
+// checksum: object picks what to decode its payload into by its header, e.g.
+// failing for versions it doesn't know, and the header is returned for the
+// caller to check the count. Files without a header fail with ErrNotSnapshot.
+func LoadSnapshot(path string, object func(header SnapshotHeader) (interface{}, error)) (SnapshotHeader, error) {
+	var header SnapshotHeader
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return header, err
+	}
+	if len(b) < snapshotHeaderSize || !bytes.Equal(b[:len(snapshotMagic)], snapshotMagic[:]) {
+		return header, ErrNotSnapshot
+	}
+	if err := binary.Read(bytes.NewReader(b[len(snapshotMagic):]), binary.BigEndian, &header); err != nil {
+		return header, err
+	}
+	payload := b[snapshotHeaderSize:]
+	if uint64(len(payload)) != header.Length {
+		return header, fmt.Errorf("snapshot truncated, length: %d, expect: %d", len(payload), header.Length)
+	}
+	if crc32.Checksum(payload, crcTable) != header.Checksum {
+		return header, ErrChecksum
+	}
+	v, err := object(header)
+	if err != nil {
+		return header, err
+	}
+	return header, gob.NewDecoder(bytes.NewReader(payload)).Decode(v)
+}
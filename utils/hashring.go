@@ -0,0 +1,57 @@
+package utils
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// Hash maps bytes to uint32
+type Hash func(data []byte) uint32
+
+// HashRing is a consistent hash ring of nodes, each placed replicas times on
+// the ring as virtual nodes. It is not safe for concurrent access.
+type HashRing struct {
+	hash     Hash
+	replicas int
+	keys     []int // sorted
+	nodes    map[int]string
+}
+
+// NewHashRing create a new instance of HashRing, hash defaults to crc32.
+func NewHashRing(replicas int, fn Hash) *HashRing {
+	r := &HashRing{
+		hash:     fn,
+		replicas: replicas,
+		nodes:    make(map[int]string),
+	}
+	if r.hash == nil {
+		r.hash = crc32.ChecksumIEEE
+	}
+	if r.replicas < 1 {
+		r.replicas = 1
+	}
+	return r
+}
+
+// Add adds nodes to the ring.
+func (r *HashRing) Add(nodes ...string) {
+	for _, node := range nodes {
+		for i := 0; i < r.replicas; i++ {
+			hash := int(r.hash([]byte(strconv.Itoa(i) + node)))
+			r.keys = append(r.keys, hash)
+			r.nodes[hash] = node
+		}
+	}
+	sort.Ints(r.keys)
+}
+
+// Get returns the node owning key, or "" if the ring is empty.
+func (r *HashRing) Get(key string) string {
+	if len(r.keys) == 0 {
+		return ""
+	}
+	hash := int(r.hash([]byte(key)))
+	i := sort.Search(len(r.keys), func(i int) bool { return r.keys[i] >= hash })
+	return r.nodes[r.keys[i%len(r.keys)]]
+}
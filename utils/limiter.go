@@ -0,0 +1,100 @@
+package utils
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter is an adaptive token bucket. Its rate is halved whenever the
+// limited host throttles us and recovers additively, by a tenth of the
+// configured rate per success, back to the configured rate.
+// It is safe for concurrent access.
+type Limiter struct {
+	mu      sync.Mutex
+	maxRate float64 // tokens per second
+	minRate float64
+	rate    float64
+	burst   float64
+	tokens  float64
+	last    time.Time
+}
+
+// NewLimiter create a new instance of Limiter allowing rate requests per
+// second with bursts of up to burst requests, a rate of 0 means no limit.
+func NewLimiter(rate float64, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Limiter{
+		maxRate: rate,
+		minRate: rate / 64,
+		rate:    rate,
+		burst:   float64(burst),
+		tokens:  float64(burst),
+		last:    time.Now(),
+	}
+}
+
+// Wait blocks until a request may be made or ctx is done.
+func (l *Limiter) Wait(ctx context.Context) error {
+	if l.maxRate <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	// reserve a token, waiting for the debt to be paid off if there is none
+	l.tokens--
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		l.mu.Lock()
+		l.tokens++
+		l.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// Throttled halves the rate after the host throttled a request.
+func (l *Limiter) Throttled() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate /= 2
+	if l.rate < l.minRate {
+		l.rate = l.minRate
+	}
+}
+
+// Succeeded recovers the rate after a successful request.
+func (l *Limiter) Succeeded() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate += l.maxRate / 10
+	if l.rate > l.maxRate {
+		l.rate = l.maxRate
+	}
+}
+
+// Rate returns the current rate in requests per second.
+func (l *Limiter) Rate() float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
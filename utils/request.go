@@ -4,7 +4,6 @@ import (
 	"compress/flate"
 	"compress/gzip"
 	"context"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -14,6 +13,15 @@ import (
 
 type RequestOption func(*http.Request)
 
+// A StatusError reports a response with an unexpected status code.
+type StatusError struct {
+	Code int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("status code: %d", e.Code)
+}
+
 func RequestWithHeaders(headers map[string]string) RequestOption {
 	return func(req *http.Request) {
 		for k, v := range headers {
@@ -35,9 +43,22 @@ func switchContentEncoding(resp *http.Response) (bodyReader io.Reader, err error
 }
 
 func DoGetRequest(url string, timeout time.Duration, opts ...RequestOption) (b []byte, err error) {
+	b, _, err = DoGetRequestWithHeader(url, timeout, opts...)
+	return
+}
+
+// DoGetRequestWithHeader is DoGetRequest that also returns the response header,
+// e.g. to learn the charset of the body.
+func DoGetRequestWithHeader(url string, timeout time.Duration, opts ...RequestOption) (b []byte, header http.Header, err error) {
+	return DoGetRequestWithContext(context.Background(), url, timeout, opts...)
+}
+
+// DoGetRequestWithContext is DoGetRequestWithHeader that is also aborted when
+// ctx is done.
+func DoGetRequestWithContext(ctx context.Context, url string, timeout time.Duration, opts ...RequestOption) (b []byte, header http.Header, err error) {
 	defer TimeTrack(time.Now(), "DoGetRequest")
 
-	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
@@ -60,14 +81,15 @@ func DoGetRequest(url string, timeout time.Duration, opts ...RequestOption) (b [
 		return
 	}
 
-	if resp.StatusCode != 200 {
-		err = errors.New(fmt.Sprintf("status code: %d", resp.StatusCode))
-		return
-	}
-
 	defer func(Body io.ReadCloser) {
 		_ = Body.Close()
 	}(resp.Body)
+	header = resp.Header
+
+	if resp.StatusCode != 200 {
+		err = &StatusError{Code: resp.StatusCode}
+		return
+	}
 
 	bodyReader, err := switchContentEncoding(resp)
 	b, err = ioutil.ReadAll(bodyReader)
@@ -103,15 +125,15 @@ func DoPostRequest(url string, timeout time.Duration, body io.Reader, opts ...Re
 		return
 	}
 
-	if resp.StatusCode != 200 {
-		err = errors.New(fmt.Sprintf("status code: %d", resp.StatusCode))
-		return
-	}
-
 	defer func(Body io.ReadCloser) {
 		_ = Body.Close()
 	}(resp.Body)
 
+	if resp.StatusCode != 200 {
+		err = &StatusError{Code: resp.StatusCode}
+		return
+	}
+
 	bodyReader, err := switchContentEncoding(resp)
 	b, err = ioutil.ReadAll(bodyReader)
 	if err != nil {
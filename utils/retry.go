@@ -0,0 +1,83 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+)
+
+// RetryPolicy configures retries with exponential backoff and jitter.
+type RetryPolicy struct {
+	// Attempts is the maximum number of attempts, including the first one
+	Attempts int
+	// BaseDelay is the delay before the first retry, doubled for every retry
+	BaseDelay time.Duration
+	// MaxDelay caps the delay between retries
+	MaxDelay time.Duration
+	// Jitter randomizes each delay by up to this fraction of it, in [0, 1]
+	Jitter float64
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:  3,
+	BaseDelay: time.Millisecond * 200,
+	MaxDelay:  time.Second * 5,
+	Jitter:    0.5,
+}
+
+// Backoff returns the delay before the given retry, counting from 1.
+func (p RetryPolicy) Backoff(retry int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < retry && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		delay = time.Duration(float64(delay) * (1 - p.Jitter + 2*p.Jitter*rand.Float64()))
+	}
+	return delay
+}
+
+// IsRetryable reports whether err is worth retrying: timeouts, 5xx and 429.
+func IsRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.Code >= 500 || statusErr.Code == http.StatusTooManyRequests
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// Retry calls fn until it succeeds, returns an error that isn't retryable or
+// runs out of attempts, sleeping according to policy between attempts.
+func Retry(policy RetryPolicy, fn func() error) error {
+	return RetryWithContext(context.Background(), policy, fn)
+}
+
+// RetryWithContext is Retry that stops sleeping and returns ctx's error once
+// ctx is done.
+func RetryWithContext(ctx context.Context, policy RetryPolicy, fn func() error) (err error) {
+	for attempt := 1; ; attempt++ {
+		if err = fn(); err == nil || !IsRetryable(err) || attempt >= policy.Attempts {
+			return
+		}
+		timer := time.NewTimer(policy.Backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}